@@ -2,19 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
 	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/inject"
 	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/version"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 )
 
@@ -26,6 +36,17 @@ func main() {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	// retrieve command line parameters
 	flag.IntVar(&parameters.Port, "port", 443, "Webhook server port.")
+	flag.IntVar(&parameters.MetricsPort,
+		"metricsPort",
+		0,
+		"Serve /metrics over plain HTTP on this port. 0 serves it on the webhook port.",
+	)
+	flag.StringVar(&parameters.OTLPEndpoint,
+		"otlpEndpoint",
+		"",
+		"OTLP/gRPC endpoint (host:port) receiving the admission traces. Tracing is disabled when empty.",
+	)
+	flag.BoolVar(&parameters.OTLPInsecure, "otlpInsecure", false, "Send the traces to the OTLP endpoint without TLS.")
 	flag.StringVar(&parameters.CertFile,
 		"tlsCertFile",
 		"/etc/mutator/certs/cert.pem",
@@ -36,54 +57,307 @@ func main() {
 		"/etc/mutator/certs/key.pem",
 		"Path to file containing the x509 Private Key for HTTPS.",
 	)
+	selfManagedCerts := flag.Bool("selfManagedCerts",
+		false,
+		"Generate the CA and the serving certificate in a Secret and keep the caBundle of the webhook "+
+			"configuration up to date, instead of serving the tlsCertFile and tlsKeyFile",
+	)
+	var certConfig inject.SelfManagedCertConfig
+	flag.StringVar(&certConfig.Namespace,
+		"certNamespace",
+		os.Getenv("POD_NAMESPACE"),
+		"Namespace of the self-managed certificate Secret, Lease and Service (default $POD_NAMESPACE)",
+	)
+	flag.StringVar(&certConfig.SecretName, "certSecretName", "k8-injector-certs", "Self-managed certificate Secret")
+	flag.StringVar(&certConfig.ServiceName, "certServiceName", "k8-injector", "Service of the self-managed certificate")
+	flag.StringVar(&certConfig.WebhookConfigName,
+		"webhookConfigName",
+		"k8-injector",
+		"MutatingWebhookConfiguration whose caBundle is kept up to date with the self-managed CA",
+	)
+	flag.StringVar(&certConfig.LeaseName,
+		"certLeaseName",
+		"k8-injector-certs",
+		"Lease electing the replica rotating the self-managed certificates",
+	)
+	flag.DurationVar(&certConfig.CAValidity, "caValidity", inject.DefaultCAValidity, "Validity of the self-managed CA")
+	flag.DurationVar(&certConfig.CertValidity,
+		"certValidity",
+		inject.DefaultCertValidity,
+		"Validity of the self-managed serving certificate",
+	)
+	flag.DurationVar(&certConfig.RenewBefore,
+		"certRenewBefore",
+		inject.DefaultRenewBefore,
+		"Renew the self-managed CA and serving certificate that long before they expire",
+	)
 	flag.StringVar(&parameters.InjectName, "injectName", "inject", "Injector Name")
 	flag.StringVar(&parameters.InjectPrefix, "injectPrefix", "injector.server-lab.info", "Injector Prefix")
 	flag.StringVar(&parameters.InjectConfigMapName, "configName", "config", "ConfigMap Name")
+	flag.StringVar(&parameters.InjectStatusName, "statusName", "status", "Injection status annotation Name")
+	flag.StringVar(&parameters.InjectSecretName, "secretName", "secret", "Secret env annotation Name")
 	flag.StringVar(&parameters.SidecarDataKey, "sidecarDataKey", "sidecars.yaml", "ConfigMap Sidecar Data Key")
+	flag.BoolVar(&parameters.ConfigMapCache,
+		"configMapCache",
+		false,
+		"Serve ConfigMaps from an informer cache, which holds every ConfigMap matching configMapSelector in memory",
+	)
+	flag.StringVar(&parameters.ConfigMapSelector,
+		"configMapSelector",
+		"",
+		"Label selector limiting the ConfigMaps held in the cache (default all ConfigMaps)",
+	)
+	parameters.NamespaceAllowlist = inject.NamespaceAllowlist{}
+	flag.Var(parameters.NamespaceAllowlist,
+		"allowCrossNamespace",
+		"Allow pods of the target namespaces to reference sidecars of the source namespace, "+
+			"as source=target1,target2 (targets are glob patterns). Can be repeated.",
+	)
+	conflictPolicy := flag.String("conflictPolicy",
+		string(inject.ConflictPolicyError),
+		"Default policy for name conflicts of injected containers, volumes and volume mounts: error, skip or replace",
+	)
+	envMode := flag.String("envMode",
+		string(inject.EnvModeValue),
+		"Default mode of the ConfigMap env injection: value (copy the values), envFrom or keyRef (reference the ConfigMap)",
+	)
+	envMerge := flag.String("envMerge",
+		string(inject.EnvMergeOverride),
+		"Default strategy for injected env vars a container already defines: keep-existing, override or fail",
+	)
+	envNameValidation := flag.String("envNameValidation",
+		string(inject.EnvNameStrict),
+		"Validation of injected env var names: strict (C identifiers) or relaxed (Kubernetes env var names)",
+	)
+	failurePolicy := flag.String("sidecarFailurePolicy",
+		string(inject.FailurePolicyIgnore),
+		"Default policy for pods whose sidecar ConfigMap or SidecarTemplate is missing or invalid: "+
+			"ignore (admit without the sidecar) or fail (deny the pod)",
+	)
+	eventQPS := flag.Float64("eventQPS",
+		inject.DefaultEventQPS,
+		"Events per second recorded about one ConfigMap, Secret or workload once the burst is used",
+	)
+	eventBurst := flag.Int("eventBurst",
+		inject.DefaultEventBurst,
+		"Events recorded about one ConfigMap, Secret or workload before the eventQPS limit applies",
+	)
+	logFormat := flag.String("logFormat", inject.LogFormatText, "Format of the log lines: text or json")
+	logLevel := flag.String("logLevel", "info", "Minimum level of the logged lines: debug, info, warn or error")
 	// Flag.parse only covers `-version` flag but for `version`, we need to explicitly
 	// check the args
 	showVersion := flag.Bool("version", false, "Show current version")
 	flag.Parse()
 	// Either the flag or the arg should be enough to show the version
 	if *showVersion || flag.Arg(0) == "version" {
-		log.Printf("k8-injector v%s\n", version.Get())
+		fmt.Printf("k8-injector v%s\n", version.Get())
 
 		return
 	}
 
-	log.Printf("k8-injector v%s starting up...", version.Get())
+	level, err := inject.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid parameters : %v\n", err)
+		os.Exit(1)
+	}
+	logger, err := inject.NewLogger(os.Stderr, *logFormat, level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid parameters : %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	logger.Info("k8-injector starting up", "version", version.Get())
+	policy, err := inject.ParseConflictPolicy(*conflictPolicy)
+	if err != nil {
+		logger.Error("Invalid parameters", "error", err)
+		os.Exit(1)
+	}
+	parameters.ConflictPolicy = policy
+	parameters.EnvMode, err = inject.ParseEnvMode(*envMode)
+	if err != nil {
+		logger.Error("Invalid parameters", "error", err)
+		os.Exit(1)
+	}
+	parameters.EnvMergeStrategy, err = inject.ParseEnvMergeStrategy(*envMerge)
+	if err != nil {
+		logger.Error("Invalid parameters", "error", err)
+		os.Exit(1)
+	}
+	parameters.EnvNameValidation, err = inject.ParseEnvNameValidation(*envNameValidation)
+	if err != nil {
+		logger.Error("Invalid parameters", "error", err)
+		os.Exit(1)
+	}
+	parameters.FailurePolicy, err = inject.ParseFailurePolicy(*failurePolicy)
+	if err != nil {
+		logger.Error("Invalid parameters", "error", err)
+		os.Exit(1)
+	}
 	client, err := CreateClient()
 	if err != nil {
-		log.Printf("Failed to create k8 client : %v", err)
+		logger.Error("Failed to create k8 client", "error", err)
+		os.Exit(1)
+	}
+	dynamicClient, err := CreateDynamicClient()
+	if err != nil {
+		logger.Error("Failed to create k8 dynamic client", "error", err)
+		os.Exit(1)
+	}
+	metadataClient, err := CreateMetadataClient()
+	if err != nil {
+		logger.Error("Failed to create k8 metadata client", "error", err)
 		os.Exit(1)
 	}
 
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if parameters.OTLPEndpoint != "" {
+		exporter, err := inject.NewOTLPExporter(context.Background(), parameters.OTLPEndpoint, parameters.OTLPInsecure)
+		if err != nil {
+			logger.Error("Failed to create OTLP exporter", "error", err)
+			os.Exit(1)
+		}
+		tracerProvider := inject.NewTracerProvider(exporter, version.Get())
+		otel.SetTracerProvider(tracerProvider)
+		defer func() {
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				logger.Error("Failed to flush traces", "error", err)
+			}
+		}()
+	}
+
+	recorder, stopRecorder := inject.NewEventRecorder(client, float32(*eventQPS), *eventBurst)
+	defer stopRecorder()
+
+	stopCh := make(chan struct{})
+	var configMaps *inject.ConfigMapCache
+	if parameters.ConfigMapCache {
+		configMaps, err = inject.NewConfigMapCache(client, parameters.ConfigMapSelector, 0)
+		if err != nil {
+			logger.Error("Failed to create ConfigMap cache", "error", err)
+			os.Exit(1)
+		}
+		configMaps.Start(stopCh)
+		go func() {
+			if configMaps.WaitForCacheSync(stopCh) {
+				logger.Info("ConfigMap cache synced")
+			}
+		}()
+	}
+	// SidecarTemplates are few and cluster-scoped, they are always cached when the CRD is
+	// installed. Without it only ConfigMaps are used until the webhook restarts.
+	var sidecarTemplates *inject.SidecarTemplateCache
+	_, err = client.Discovery().ServerResourcesForGroupVersion(v1alpha1.SchemeGroupVersion.String())
+	if k8serrors.IsNotFound(err) {
+		logger.Info("SidecarTemplate CRD not installed, only ConfigMaps are used")
+		dynamicClient = nil
+	} else {
+		sidecarTemplates = inject.NewSidecarTemplateCache(dynamicClient, 0)
+		sidecarTemplates.Start(stopCh)
+		go func() {
+			if sidecarTemplates.WaitForCacheSync(stopCh) {
+				logger.Info("SidecarTemplate cache synced")
+			}
+		}()
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	metrics := inject.NewMetrics(registry)
+
+	var certificates *inject.CertificateReloader
+	if *selfManagedCerts {
+		if certConfig.Namespace == "" {
+			logger.Error("Invalid parameters", "error", "certNamespace is required with selfManagedCerts")
+			os.Exit(1)
+		}
+		certConfig.Identity = os.Getenv("POD_NAME")
+		if certConfig.Identity == "" {
+			certConfig.Identity, _ = os.Hostname()
+		}
+		certificates, _ = inject.NewCertificateReloader("", "", logger, metrics)
+		manager, err := inject.NewCertificateManager(client, certConfig, certificates, logger)
+		if err != nil {
+			logger.Error("Invalid parameters", "error", err)
+			os.Exit(1)
+		}
+		if err = manager.Start(stopCh); err != nil {
+			logger.Error("Failed to start the certificate manager", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		certificates, err = inject.NewCertificateReloader(parameters.CertFile, parameters.KeyFile, logger, metrics)
+		if err != nil {
+			logger.Error("Failed to load the serving certificate", "error", err)
+			os.Exit(1)
+		}
+		if err = certificates.Start(stopCh); err != nil {
+			logger.Error("Failed to watch the serving certificate", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	whsvr := &inject.WebhookServer{
 		Params: parameters,
 		Server: &http.Server{
-			Addr:              fmt.Sprintf(":%v", parameters.Port),
-			TLSConfig:         nil,
+			Addr: fmt.Sprintf(":%v", parameters.Port),
+			TLSConfig: &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certificates.GetCertificate,
+			},
 			ReadHeaderTimeout: 3 * time.Second,
 		},
-		K8sClient: client,
+		K8sClient:        client,
+		DynamicClient:    dynamicClient,
+		MetadataClient:   metadataClient,
+		ConfigMaps:       configMaps,
+		SidecarTemplates: sidecarTemplates,
+		Recorder:         recorder,
+		Metrics:          metrics,
+		Certificates:     certificates,
+		Logger:           logger,
 	}
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", whsvr.Serve)
+	mux.HandleFunc("/livez", whsvr.Health)
 	mux.HandleFunc("/healthz", whsvr.Health)
+	mux.HandleFunc("/readyz", whsvr.Ready)
 	whsvr.Server.Handler = mux
+
+	var metricsServer *http.Server
+	if parameters.MetricsPort > 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler)
+		metricsServer = &http.Server{
+			Addr:              fmt.Sprintf(":%v", parameters.MetricsPort),
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 3 * time.Second,
+		}
+		go func() {
+			logger.Info("Serving metrics", "addr", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Failed to serve metrics", "error", err)
+				os.Exit(1)
+			}
+		}()
+	} else {
+		mux.Handle("/metrics", metricsHandler)
+	}
 	// start webhook server in goroutine
 	go func() {
-		log.Printf("Serving mutating admission webhook on %s", whsvr.Server.Addr)
+		logger.Info("Serving mutating admission webhook", "addr", whsvr.Server.Addr)
+		// The keypair is served by the reloader of the TLSConfig.
 		startServer := func() error {
-			return whsvr.Server.ListenAndServeTLS(
-				parameters.CertFile,
-				parameters.KeyFile,
-			)
+			return whsvr.Server.ListenAndServeTLS("", "")
 		}
 
 		if err = startServer(); err != nil {
-			log.Printf("Failed to listen and serve: %v", err)
+			logger.Error("Failed to listen and serve", "error", err)
 			os.Exit(1)
 		}
 	}()
@@ -92,10 +366,16 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	log.Printf("Received OS shutdown signal, shutting down webhook server gracefully...")
+	logger.Info("Received OS shutdown signal, shutting down webhook server gracefully")
+	close(stopCh)
 	err = whsvr.Server.Shutdown(context.Background())
 	if err != nil {
-		log.Printf("Failed to shutdown web server %v", err)
+		logger.Error("Failed to shutdown web server", "error", err)
+	}
+	if metricsServer != nil {
+		if err = metricsServer.Shutdown(context.Background()); err != nil {
+			logger.Error("Failed to shutdown metrics server", "error", err)
+		}
 	}
 }
 
@@ -108,3 +388,23 @@ func CreateClient() (*kubernetes.Clientset, error) {
 
 	return kubernetes.NewForConfig(config)
 }
+
+// CreateDynamicClient Create the dynamic client used for custom resources.
+func CreateDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error setting up cluster config")
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
+// CreateMetadataClient Create the client reading the metadata of objects without their data.
+func CreateMetadataClient() (metadata.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error setting up cluster config")
+	}
+
+	return metadata.NewForConfig(config)
+}
@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the v1alpha1 API of the injector.server-lab.info group.
+// +kubebuilder:object:generate=true
+// +groupName=injector.server-lab.info
+package v1alpha1
@@ -0,0 +1,99 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in SidecarTemplateStatus.
+const (
+	// ConditionParsed reports whether the webhook could decode and validate the template.
+	ConditionParsed = "Parsed"
+	// ConditionInjected reports whether the template has been injected into a pod.
+	ConditionInjected = "Injected"
+)
+
+// Condition reasons reported in SidecarTemplateStatus.
+const (
+	ReasonParsed     = "Parsed"
+	ReasonParseError = "ParseError"
+	ReasonInjected   = "Injected"
+)
+
+// SidecarTemplateSpec describes the sidecar injected into pods referencing the template.
+type SidecarTemplateSpec struct {
+	// InitContainers are appended to the pod init containers.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// Containers are appended to the pod containers.
+	// +optional
+	Containers []corev1.Container `json:"containers,omitempty"`
+	// Volumes are appended to the pod volumes.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// ImagePullSecrets are appended to the pod image pull secrets.
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Annotations are merged into the pod annotations.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Labels are merged into the pod labels.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// VolumeMounts are added to the existing containers of the pod, e.g. to share one of
+	// the sidecar volumes with the application.
+	// +optional
+	VolumeMounts []SidecarVolumeMount `json:"volumeMounts,omitempty"`
+	// ConflictPolicy decides what happens when an injected container, volume or volume
+	// mount has the name of an existing one. Defaults to the webhook conflict policy.
+	// +optional
+	// +kubebuilder:validation:Enum=error;skip;replace
+	ConflictPolicy string `json:"conflictPolicy,omitempty"`
+}
+
+// SidecarVolumeMount is a volume mount added to the existing containers of the pod
+// selected by Containers and ExcludeContainers.
+type SidecarVolumeMount struct {
+	corev1.VolumeMount `json:",inline"`
+	// Containers are path.Match patterns of the container names receiving the mount.
+	// The mount is added to every container when empty.
+	// +optional
+	Containers []string `json:"containers,omitempty"`
+	// ExcludeContainers are path.Match patterns of container names never receiving the
+	// mount, they take precedence over Containers.
+	// +optional
+	ExcludeContainers []string `json:"excludeContainers,omitempty"`
+}
+
+// SidecarTemplateStatus is the observed state of a SidecarTemplate.
+type SidecarTemplateStatus struct {
+	// Conditions describe the parse and usage state of the template.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// SidecarTemplate is a cluster-scoped sidecar definition referenced by the inject annotation.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=sct
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Parsed",type=string,JSONPath=`.status.conditions[?(@.type=="Parsed")].status`
+// +kubebuilder:printcolumn:name="Injected",type=string,JSONPath=`.status.conditions[?(@.type=="Injected")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type SidecarTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SidecarTemplateSpec   `json:"spec,omitempty"`
+	Status SidecarTemplateStatus `json:"status,omitempty"`
+}
+
+// SidecarTemplateList is a list of SidecarTemplate.
+// +kubebuilder:object:root=true
+type SidecarTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []SidecarTemplate `json:"items"`
+}
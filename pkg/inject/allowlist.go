@@ -0,0 +1,63 @@
+package inject
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// NamespaceAllowlist maps a source namespace to the target namespaces whose pods may
+// reference sidecar ConfigMaps of the source namespace. Targets are path.Match patterns,
+// so "*" allows every namespace. A namespace can always reference its own ConfigMaps.
+type NamespaceAllowlist map[string][]string
+
+// Allowed reports whether pods of target may reference ConfigMaps of source.
+func (a NamespaceAllowlist) Allowed(source, target string) bool {
+	if source == target {
+		return true
+	}
+
+	for _, pattern := range a[source] {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String implements flag.Value.
+func (a NamespaceAllowlist) String() string {
+	sources := make([]string, 0, len(a))
+	for source := range a {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	entries := make([]string, 0, len(sources))
+	for _, source := range sources {
+		entries = append(entries, source+"="+strings.Join(a[source], ","))
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// Set implements flag.Value, it parses one "source=target1,target2" entry.
+func (a NamespaceAllowlist) Set(value string) error {
+	source, targets, ok := strings.Cut(value, "=")
+	source = strings.TrimSpace(source)
+	if !ok || source == "" || strings.TrimSpace(targets) == "" {
+		return fmt.Errorf("invalid namespace allowlist entry %q, expecting source=target1,target2", value)
+	}
+
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if _, err := path.Match(target, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %w", target, err)
+		}
+		a[source] = append(a[source], target)
+	}
+
+	return nil
+}
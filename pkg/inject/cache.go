@@ -0,0 +1,203 @@
+package inject
+
+import (
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// parsedSidecars memoizes the sidecars of one ConfigMap revision: the parsed template when
+// it is templated, else the decoded sidecars.
+type parsedSidecars struct {
+	resourceVersion string
+	dataKey         string
+	templated       bool
+	template        *template.Template
+	sidecars        []Sidecar
+	err             error
+}
+
+// ConfigMapCache serves ConfigMaps from a shared informer, so that admissions do not query
+// the apiserver. Sidecars decoded from a ConfigMap, or the template parsed from it, are
+// memoized until its resourceVersion changes.
+type ConfigMapCache struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.ConfigMapLister
+	synced  cache.InformerSynced
+
+	mu       sync.Mutex
+	sidecars map[string]parsedSidecars
+}
+
+// NewConfigMapCache creates a ConfigMap cache limited to the ConfigMaps matching
+// labelSelector. An empty selector caches every ConfigMap of the cluster.
+func NewConfigMapCache(
+	client kubernetes.Interface,
+	labelSelector string,
+	resync time.Duration,
+) (*ConfigMapCache, error) {
+	if _, err := labels.Parse(labelSelector); err != nil {
+		return nil, fmt.Errorf("invalid ConfigMap label selector %q: %w", labelSelector, err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		resync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSelector
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps()
+
+	c := &ConfigMapCache{
+		factory:  factory,
+		lister:   informer.Lister(),
+		synced:   informer.Informer().HasSynced,
+		sidecars: map[string]parsedSidecars{},
+	}
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.forget,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Start starts the informer, it runs until stopCh is closed.
+func (c *ConfigMapCache) Start(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+}
+
+// WaitForCacheSync blocks until the informer has synced or stopCh is closed.
+func (c *ConfigMapCache) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, c.synced)
+}
+
+// HasSynced reports whether the informer has completed its initial list.
+func (c *ConfigMapCache) HasSynced() bool {
+	return c.synced()
+}
+
+// Get returns the cached ConfigMap. A NotFound error is returned for ConfigMaps that do
+// not exist or do not match the label selector.
+func (c *ConfigMapCache) Get(namespace, name string) (*corev1.ConfigMap, error) {
+	return c.lister.ConfigMaps(namespace).Get(name)
+}
+
+// Sidecars parses the sidecars.yaml stored under dataKey, see parseSidecars, reusing the
+// previous result when the ConfigMap has not changed.
+func (c *ConfigMapCache) Sidecars(
+	cm *corev1.ConfigMap,
+	dataKey string,
+	templated bool,
+) (*template.Template, []Sidecar, error) {
+	key := cm.Namespace + "/" + cm.Name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if parsed, ok := c.sidecars[key]; ok &&
+		parsed.resourceVersion == cm.ResourceVersion &&
+		parsed.dataKey == dataKey &&
+		parsed.templated == templated {
+		return parsed.template, parsed.sidecars, parsed.err
+	}
+
+	tmpl, sidecars, err := parseSidecars(key, cm.Data[dataKey], templated)
+	c.sidecars[key] = parsedSidecars{
+		resourceVersion: cm.ResourceVersion,
+		dataKey:         dataKey,
+		templated:       templated,
+		template:        tmpl,
+		sidecars:        sidecars,
+		err:             err,
+	}
+
+	return tmpl, sidecars, err
+}
+
+// forget drops the memoized sidecars of a deleted ConfigMap.
+func (c *ConfigMapCache) forget(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sidecars, key)
+}
+
+// SidecarTemplateCache serves the cluster-scoped SidecarTemplates from a shared informer,
+// so that admissions do not query the apiserver.
+type SidecarTemplateCache struct {
+	factory dynamicinformer.DynamicSharedInformerFactory
+	lister  cache.GenericLister
+	synced  cache.InformerSynced
+}
+
+// NewSidecarTemplateCache creates a cache of every SidecarTemplate. The CRD must be
+// installed, else the informer never syncs.
+func NewSidecarTemplateCache(client dynamic.Interface, resync time.Duration) *SidecarTemplateCache {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+	informer := factory.ForResource(v1alpha1.SidecarTemplateResource)
+
+	return &SidecarTemplateCache{
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+	}
+}
+
+// Start starts the informer, it runs until stopCh is closed.
+func (c *SidecarTemplateCache) Start(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+}
+
+// WaitForCacheSync blocks until the informer has synced or stopCh is closed.
+func (c *SidecarTemplateCache) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, c.synced)
+}
+
+// HasSynced reports whether the informer has completed its initial list.
+func (c *SidecarTemplateCache) HasSynced() bool {
+	return c.synced()
+}
+
+// Get returns a copy of the cached SidecarTemplate, nil when it does not exist.
+func (c *SidecarTemplateCache) Get(name string) (*v1alpha1.SidecarTemplate, error) {
+	obj, err := c.lister.Get(name)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	content, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected SidecarTemplate %s of type %T", name, obj)
+	}
+	var template v1alpha1.SidecarTemplate
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(content.UnstructuredContent(), &template); err != nil {
+		return nil, fmt.Errorf("could not decode SidecarTemplate %s: %w", name, err)
+	}
+
+	return &template, nil
+}
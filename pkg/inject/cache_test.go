@@ -0,0 +1,115 @@
+package inject
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapCache(t *testing.T) {
+	scm := sidecarconfigMap("dummy", "sidecar-config")
+	scm.Labels = map[string]string{"injector": "enabled"}
+	scm.ResourceVersion = "1"
+	cm := configMap("dummy", "test-config")
+	client := fake.NewSimpleClientset(&scm, &cm)
+
+	configMaps, err := NewConfigMapCache(client, "injector=enabled", 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	whsvr := &WebhookServer{K8sClient: client, ConfigMaps: configMaps}
+
+	assert.Equal(t, readinessCheck{Name: checkConfigMapCache, Message: "not synced"}, whsvr.checkConfigMapCache())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	configMaps.Start(stopCh)
+	assert.True(t, configMaps.WaitForCacheSync(stopCh))
+
+	assert.True(t, whsvr.checkConfigMapCache().Ready)
+
+	cached, err := whsvr.getConfigMap(context.Background(), "dummy", "sidecar-config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = whsvr.getConfigMap(context.Background(), "dummy", "test-config")
+	assert.True(t, k8serrors.IsNotFound(err), "unlabelled ConfigMaps are not cached")
+
+	data := SidecarTemplateData{Namespace: "dummy"}
+	injectorConfig := testInjectorConfig()
+	sidecars, err := whsvr.configMapSidecars(cached, injectorConfig, data)
+	if !assert.NoError(t, err) || !assert.Len(t, sidecars, 1) {
+		return
+	}
+	assert.Equal(t, "haystack-agent", sidecars[0].Name)
+
+	// A ConfigMap with the same resourceVersion is served from the memoized sidecars.
+	stale := cached.DeepCopy()
+	stale.Data["sidecars.yaml"] = "- name: log-agent"
+	memoized, err := whsvr.configMapSidecars(stale, injectorConfig, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "haystack-agent", memoized[0].Name)
+
+	stale.ResourceVersion = "2"
+	reparsed, err := whsvr.configMapSidecars(stale, injectorConfig, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "log-agent", reparsed[0].Name)
+
+	// The template is memoized, it is rendered for every pod.
+	stale.ResourceVersion = "3"
+	stale.Annotations = map[string]string{"injector.server-lab.info/templated": "true"}
+	stale.Data["sidecars.yaml"] = "- name: {{ .Namespace }}"
+	rendered, err := whsvr.configMapSidecars(stale, injectorConfig, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy", rendered[0].Name)
+	rendered, err = whsvr.configMapSidecars(stale, injectorConfig, SidecarTemplateData{Namespace: "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, "other", rendered[0].Name)
+}
+
+func TestConfigMapCacheInvalidSelector(t *testing.T) {
+	_, err := NewConfigMapCache(fake.NewSimpleClientset(), "in valid=", 0)
+	assert.Error(t, err)
+}
+
+func TestReadyWithoutCache(t *testing.T) {
+	whsvr := &WebhookServer{}
+	check := whsvr.checkConfigMapCache()
+	assert.Equal(t, readinessCheck{Name: checkConfigMapCache, Ready: true, Message: "disabled"}, check)
+}
+
+func TestSidecarTemplateCache(t *testing.T) {
+	dynamicClient := newTestDynamicClient()
+	templates := NewSidecarTemplateCache(dynamicClient, 0)
+	whsvr := &WebhookServer{
+		K8sClient:        fake.NewSimpleClientset(),
+		DynamicClient:    dynamicClient,
+		SidecarTemplates: templates,
+	}
+
+	assert.Equal(t, readinessCheck{Name: checkTemplateCache, Message: "not synced"}, whsvr.checkTemplateCache())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	templates.Start(stopCh)
+	assert.True(t, templates.WaitForCacheSync(stopCh))
+	assert.Equal(t, readinessCheck{Name: checkTemplateCache, Ready: true, Message: "synced"}, whsvr.checkTemplateCache())
+
+	ctx := context.Background()
+	template, err := whsvr.getSidecarTemplate(ctx, "sidecar-template")
+	if assert.NoError(t, err) && assert.NotNil(t, template) {
+		assert.Equal(t, "sidecar-template", template.Name)
+		assert.NotEmpty(t, template.Spec.Containers)
+	}
+	template, err = whsvr.getSidecarTemplate(ctx, "sidecar-config")
+	assert.NoError(t, err)
+	assert.Nil(t, template)
+
+	for _, action := range dynamicClient.(*dynamicfake.FakeDynamicClient).Actions() {
+		assert.False(t, action.Matches("get", "sidecartemplates"), "SidecarTemplates are served from the cache")
+	}
+}
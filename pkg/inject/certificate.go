@@ -0,0 +1,203 @@
+package inject
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/samber/lo"
+)
+
+// loadedCertificate is a validated keypair with the PEM files it was loaded from.
+type loadedCertificate struct {
+	certificate *tls.Certificate
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// CertificateReloader serves the keypair of the certificate and key files through
+// tls.Config.GetCertificate, and swaps in the new keypair when the files change, e.g. when
+// cert-manager renews the mounted Secret. Without files the keypair is set with Update.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+	metrics  *Metrics
+
+	mu     sync.Mutex
+	loaded atomic.Pointer[loadedCertificate]
+}
+
+// NewCertificateReloader loads the keypair of certFile and keyFile, when set. Reloads are
+// logged to logger, else the default logger, and recorded in metrics.
+func NewCertificateReloader(
+	certFile string,
+	keyFile string,
+	logger *slog.Logger,
+	metrics *Metrics,
+) (*CertificateReloader, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger.With("certFile", certFile, "keyFile", keyFile),
+		metrics:  metrics,
+	}
+	if certFile == "" && keyFile == "" {
+		return r, nil
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current keypair, it implements tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loaded := r.loaded.Load()
+	if loaded == nil {
+		return nil, errors.New("no serving certificate loaded")
+	}
+
+	return loaded.certificate, nil
+}
+
+// Leaf returns the current serving certificate, nil until one is loaded.
+func (r *CertificateReloader) Leaf() *x509.Certificate {
+	loaded := r.loaded.Load()
+	if loaded == nil {
+		return nil
+	}
+
+	return loaded.certificate.Leaf
+}
+
+// Reload loads the files again and swaps in their keypair when it changed and is valid.
+// On error the previous keypair is kept. It reports whether the keypair was swapped.
+func (r *CertificateReloader) Reload() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		r.metrics.certificateReloaded(nil)
+		return false, fmt.Errorf("could not read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		r.metrics.certificateReloaded(nil)
+		return false, fmt.Errorf("could not read key: %w", err)
+	}
+
+	return r.swap(certPEM, keyPEM, r.certFile)
+}
+
+// Update swaps in the PEM keypair, e.g. read from a Secret, when it changed and is valid.
+// On error the previous keypair is kept. It reports whether the keypair was swapped.
+func (r *CertificateReloader) Update(certPEM, keyPEM []byte) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.swap(certPEM, keyPEM, "certificate")
+}
+
+// swap validates the keypair and stores it, name identifies the certificate in errors.
+func (r *CertificateReloader) swap(certPEM, keyPEM []byte, name string) (bool, error) {
+	loaded, err := parseKeyPair(certPEM, keyPEM, name)
+	if err != nil {
+		r.metrics.certificateReloaded(nil)
+		return false, err
+	}
+	previous := r.loaded.Load()
+	if previous != nil && bytes.Equal(previous.certPEM, loaded.certPEM) && bytes.Equal(previous.keyPEM, loaded.keyPEM) {
+		return false, nil
+	}
+	r.loaded.Store(loaded)
+	r.metrics.certificateReloaded(loaded.certificate.Leaf)
+
+	leaf := loaded.certificate.Leaf
+	r.logger.Info(
+		"Loaded serving certificate",
+		"subject", leaf.Subject.String(),
+		"serial", leaf.SerialNumber.String(),
+		"notAfter", leaf.NotAfter.UTC().Format(time.RFC3339),
+	)
+
+	return true, nil
+}
+
+// parseKeyPair validates the keypair: the key must match the certificate, which must not
+// be expired.
+func parseKeyPair(certPEM, keyPEM []byte, name string) (*loadedCertificate, error) {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keypair %s: %w", name, err)
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate %s: %w", name, err)
+	}
+	if time.Now().After(certificate.Leaf.NotAfter) {
+		return nil, fmt.Errorf(
+			"certificate %s expired at %s",
+			name,
+			certificate.Leaf.NotAfter.UTC().Format(time.RFC3339),
+		)
+	}
+
+	return &loadedCertificate{certificate: &certificate, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// Start watches the directories of the files until stopCh is closed. Kubernetes updates a
+// mounted Secret by swapping a symlink, so any change in the directories triggers a reload.
+func (r *CertificateReloader) Start(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, dir := range lo.Uniq([]string{filepath.Dir(r.certFile), filepath.Dir(r.keyFile)}) {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("could not watch %s: %w", dir, err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				r.logger.Debug("Certificate directory changed", "event", event.String())
+				// The cert and key are not written at once, a mismatching keypair is
+				// reloaded on the event of the second file.
+				if _, err := r.Reload(); err != nil {
+					r.logger.Warn("Keeping the previous serving certificate", "error", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.logger.Error("Error watching the serving certificate", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
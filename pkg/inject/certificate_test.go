@@ -0,0 +1,99 @@
+package inject
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func servedSerial(t *testing.T, reloader *CertificateReloader) int64 {
+	cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+	if !assert.NoError(t, err) {
+		return 0
+	}
+
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertificateReloader(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+
+	reloader, err := NewCertificateReloader(certFile, keyFile, nil, metrics)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1), servedSerial(t, reloader))
+	assert.Equal(t, float64(now.Add(time.Hour).Unix()), testutil.ToFloat64(metrics.certificateExpiry))
+
+	swapped, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.False(t, swapped, "unchanged files are not reloaded")
+
+	// A certificate with the key of another keypair is rejected.
+	other := t.TempDir()
+	otherCert, _ := writeTestKeyPair(t, other, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	certPEM, err := os.ReadFile(otherCert)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	_, err = reloader.Reload()
+	assert.ErrorContains(t, err, "invalid keypair")
+	assert.Equal(t, int64(1), servedSerial(t, reloader))
+
+	writeTestKeyPair(t, dir, 3, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	_, err = reloader.Reload()
+	assert.ErrorContains(t, err, "expired at")
+	assert.Equal(t, int64(1), servedSerial(t, reloader))
+
+	writeTestKeyPair(t, dir, 4, now.Add(-time.Hour), now.Add(2*time.Hour))
+	swapped, err = reloader.Reload()
+	assert.NoError(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, int64(4), servedSerial(t, reloader))
+	assert.Equal(t, int64(4), reloader.Leaf().SerialNumber.Int64())
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.certificateReloads.WithLabelValues("success")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.certificateReloads.WithLabelValues("failure")))
+	assert.Equal(t, float64(now.Add(2*time.Hour).Unix()), testutil.ToFloat64(metrics.certificateExpiry))
+}
+
+func TestCertificateReloaderWatch(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	reloader, err := NewCertificateReloader(certFile, keyFile, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if !assert.NoError(t, reloader.Start(stopCh)) {
+		return
+	}
+
+	writeTestKeyPair(t, dir, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.Eventually(t, func() bool {
+		return reloader.Leaf().SerialNumber.Int64() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The readiness check reports the served certificate.
+	whsvr := &WebhookServer{Certificates: reloader}
+	whsvr.Params.CertFile = filepath.Join(dir, "missing.pem")
+	check := whsvr.checkCertificate(now)
+	assert.True(t, check.Ready, check.Message)
+}
+
+func TestCertificateReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewCertificateReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil, nil)
+	assert.ErrorContains(t, err, "could not read certificate")
+}
@@ -1,23 +1,62 @@
 package inject
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
 
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// Sidecar Kubernetes Sidecar Injector schema.
+// Sidecar Kubernetes Sidecar Injector schema, its YAML is decoded through the JSON tags.
 type Sidecar struct {
-	Name             string                        `yaml:"name"`
-	InitContainers   []corev1.Container            `yaml:"initContainers"`
-	Containers       []corev1.Container            `yaml:"containers"`
-	Volumes          []corev1.Volume               `yaml:"volumes"`
-	ImagePullSecrets []corev1.LocalObjectReference `yaml:"imagePullSecrets"`
-	Annotations      map[string]string             `yaml:"annotations"`
-	Labels           map[string]string             `yaml:"labels"`
-	VolumeMounts     []corev1.VolumeMount          `yaml:"vplumeMounts"`
+	Name             string                        `json:"name"`
+	InitContainers   []corev1.Container            `json:"initContainers"`
+	Containers       []corev1.Container            `json:"containers"`
+	Volumes          []corev1.Volume               `json:"volumes"`
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets"`
+	Annotations      map[string]string             `json:"annotations"`
+	Labels           map[string]string             `json:"labels"`
+	// VolumeMounts are added to the existing containers of the pod.
+	VolumeMounts []SidecarVolumeMount `json:"volumeMounts,omitempty"`
+	// ConflictPolicy overrides the global conflict policy for the items of this sidecar.
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// deprecatedVolumeMounts is set when VolumeMounts were read from vplumeMounts.
+	deprecatedVolumeMounts bool
+}
+
+// SidecarVolumeMount is a volume mount of a sidecar targeting the pod containers.
+type SidecarVolumeMount = v1alpha1.SidecarVolumeMount
+
+// UnmarshalJSON accepts the misspelled vplumeMounts key of earlier releases as a
+// deprecated alias of volumeMounts, and validates the conflict policy. The use of the
+// alias is reported in the warnings of the admissions injecting the sidecar.
+func (s *Sidecar) UnmarshalJSON(data []byte) error {
+	type sidecar Sidecar
+	var decoded struct {
+		sidecar
+		DeprecatedVolumeMounts []SidecarVolumeMount `json:"vplumeMounts"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*s = Sidecar(decoded.sidecar)
+	if s.ConflictPolicy != "" {
+		policy, err := ParseConflictPolicy(string(s.ConflictPolicy))
+		if err != nil {
+			return fmt.Errorf("sidecar %s: %w", s.Name, err)
+		}
+		s.ConflictPolicy = policy
+	}
+	if len(decoded.DeprecatedVolumeMounts) > 0 {
+		s.deprecatedVolumeMounts = true
+		s.VolumeMounts = append(s.VolumeMounts, decoded.DeprecatedVolumeMounts...)
+	}
+
+	return nil
 }
 
 func metaName(meta *metav1.ObjectMeta) string {
@@ -34,30 +73,18 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta, injecto
 	// skip special Kubernetes system namespaces.
 	for _, namespace := range ignoredList {
 		if metadata.Namespace == namespace {
-			log.Printf(
-				"Skip mutation for %v for it' in special namespace:%v",
-				metaName(metadata),
-				metadata.Namespace,
-			)
-
 			return false
 		}
 	}
 
 	injectValue, _ := getAnnotation(metadata, injectorConfig.InjectName, injectorConfig.InjectPrefix)
 	configValue, _ := getAnnotation(metadata, injectorConfig.InjectConfigMapName, injectorConfig.InjectPrefix)
+	secretValue, _ := getAnnotation(metadata, injectorConfig.InjectSecretName, injectorConfig.InjectPrefix)
 	required := false
-	if injectValue != "" || configValue != "" {
+	if injectValue != "" || configValue != "" || secretValue != "" {
 		required = true
 	}
 
-	log.Printf(
-		"Mutation policy for %s/%s: required:%v",
-		metaName(metadata),
-		metadata.Name,
-		required,
-	)
-
 	return required
 }
 
@@ -1,18 +1,74 @@
 package inject
 
 import (
+	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type ContainerVolumeMounts map[string][]corev1.VolumeMount
 
 type PatchConfig struct {
-	InitContainers        []corev1.Container            `yaml:"initContainers"`
-	Containers            []corev1.Container            `yaml:"containers"`
-	Volumes               []corev1.Volume               `yaml:"volumes"`
-	Envs                  []corev1.EnvVar               `yaml:"envs"`
+	InitContainers []corev1.Container `yaml:"initContainers"`
+	Containers     []corev1.Container `yaml:"containers"`
+	Volumes        []corev1.Volume    `yaml:"volumes"`
+	EnvInjections  []EnvInjection     `yaml:"-"`
+	// ContainerEnvs and InitContainerEnvs are the merged env by container index, see
+	// resolveEnvs.
+	ContainerEnvs         map[int]ContainerEnv          `yaml:"-"`
+	InitContainerEnvs     map[int]ContainerEnv          `yaml:"-"`
 	ContainerVolumeMounts ContainerVolumeMounts         `yaml:"volumeMounts"`
 	ImagePullSecrets      []corev1.LocalObjectReference `yaml:"imagePullSecrets"`
 	Annotations           map[string]string             `yaml:"annotations"`
 	Labels                map[string]string             `yaml:"labels"`
+	// Origins are the sidecars that contributed the injected items.
+	Origins PatchOrigins `yaml:"-"`
+	// Replacements are existing items overridden under the replace conflict policy.
+	Replacements Replacements `yaml:"-"`
+}
+
+// AddSidecar merges the sidecar definition into the patch configuration. The sidecar
+// volume mounts are added to the matching containers among the pod containers. It returns
+// the origin of the sidecar items, which tells whether they were all dropped once the
+// conflicts are resolved.
+func (c *PatchConfig) AddSidecar(sidecar Sidecar, containers []corev1.Container) *PatchOrigin {
+	origin := &PatchOrigin{Sidecar: sidecar.Name, Policy: sidecar.ConflictPolicy}
+	originsOf := func(count int) []*PatchOrigin {
+		origin.items += count
+		return lo.Times(count, func(int) *PatchOrigin { return origin })
+	}
+	c.Origins.InitContainers = append(c.Origins.InitContainers, originsOf(len(sidecar.InitContainers))...)
+	c.Origins.Containers = append(c.Origins.Containers, originsOf(len(sidecar.Containers))...)
+	c.Origins.Volumes = append(c.Origins.Volumes, originsOf(len(sidecar.Volumes))...)
+	for _, mount := range sidecar.VolumeMounts {
+		for _, container := range containers {
+			if !volumeMountTargets(mount, container.Name) {
+				continue
+			}
+			if c.ContainerVolumeMounts == nil {
+				c.ContainerVolumeMounts = ContainerVolumeMounts{}
+			}
+			c.ContainerVolumeMounts[container.Name] = append(
+				c.ContainerVolumeMounts[container.Name],
+				mount.VolumeMount,
+			)
+			if c.Origins.VolumeMounts == nil {
+				c.Origins.VolumeMounts = map[string][]*PatchOrigin{}
+			}
+			c.Origins.VolumeMounts[container.Name] = append(c.Origins.VolumeMounts[container.Name], originsOf(1)...)
+		}
+	}
+
+	c.InitContainers = append(c.InitContainers, sidecar.InitContainers...)
+	c.Containers = append(c.Containers, sidecar.Containers...)
+	c.Volumes = append(c.Volumes, sidecar.Volumes...)
+	c.ImagePullSecrets = append(c.ImagePullSecrets, sidecar.ImagePullSecrets...)
+	c.Annotations = MergeMaps(c.Annotations, sidecar.Annotations)
+	c.Labels = MergeMaps(c.Labels, sidecar.Labels)
+
+	return origin
+}
+
+// volumeMountTargets reports whether the sidecar volume mount selects the container.
+func volumeMountTargets(mount SidecarVolumeMount, container string) bool {
+	return containerSelected(container, mount.Containers, mount.ExcludeContainers)
 }
@@ -0,0 +1,303 @@
+package inject
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConflictPolicy decides what happens when an injected container, volume or volume mount
+// has the same name (mount path for volume mounts) as an existing or another injected one.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyError denies the pod.
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicySkip keeps the existing item and drops the injected one.
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyReplace overrides the existing item with the injected one.
+	ConflictPolicyReplace ConflictPolicy = "replace"
+)
+
+// ParseConflictPolicy validates a conflict policy name.
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case ConflictPolicyError, ConflictPolicySkip, ConflictPolicyReplace:
+		return policy, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid conflict policy %q, expecting one of %s, %s, %s",
+			value,
+			ConflictPolicyError,
+			ConflictPolicySkip,
+			ConflictPolicyReplace,
+		)
+	}
+}
+
+// PatchOrigin records which sidecar contributed injected items and its conflict policy.
+type PatchOrigin struct {
+	Sidecar string
+	Policy  ConflictPolicy
+	// items counts the contributed items subject to conflicts, injected whether
+	// resolveConflicts kept one of them.
+	items    int
+	injected bool
+}
+
+// dropped reports whether resolveConflicts dropped every item the sidecar contributed.
+func (o *PatchOrigin) dropped() bool {
+	return o.items > 0 && !o.injected
+}
+
+// PatchOrigins are the origins of the injected items, in the order of the items of the
+// PatchConfig.
+type PatchOrigins struct {
+	InitContainers []*PatchOrigin
+	Containers     []*PatchOrigin
+	Volumes        []*PatchOrigin
+	// VolumeMounts are keyed by container name.
+	VolumeMounts map[string][]*PatchOrigin
+}
+
+// Replacements are existing pod items overridden by injected ones, keyed by their index.
+type Replacements struct {
+	InitContainers map[int]corev1.Container
+	Containers     map[int]corev1.Container
+	Volumes        map[int]corev1.Volume
+	// VolumeMounts are keyed by container name, then by volume mount index.
+	VolumeMounts map[string]map[int]corev1.VolumeMount
+}
+
+// conflictResolver applies the conflict policies of a PatchConfig.
+type conflictResolver struct {
+	defaultPolicy ConflictPolicy
+	warnings      []string
+}
+
+// origin returns the origin of an item with the default policy applied, an item without
+// origin gets the default policy.
+func (r *conflictResolver) origin(itemOrigin *PatchOrigin) PatchOrigin {
+	var origin PatchOrigin
+	if itemOrigin != nil {
+		origin = *itemOrigin
+	}
+	if origin.Policy == "" {
+		origin.Policy = r.defaultPolicy
+	}
+	if origin.Policy == "" {
+		origin.Policy = ConflictPolicyError
+	}
+
+	return origin
+}
+
+// resolveNamed removes the conflicting items from added according to the policy of their
+// origin, origins being in the order of added. It returns the remaining items with their
+// origins and the existing items to replace by index. Names in reserved belong to items of
+// another kind, which can only be skipped, never replaced. The origins of the remaining
+// and replacing items are marked injected.
+func resolveNamed[T any](
+	r *conflictResolver,
+	kind string,
+	existing []T,
+	reserved map[string]string,
+	added []T,
+	origins []*PatchOrigin,
+	name func(T) string,
+) ([]T, []*PatchOrigin, map[int]T, error) {
+	existingIndex := map[string]int{}
+	for idx, item := range existing {
+		existingIndex[name(item)] = idx
+	}
+
+	var replacements map[int]T
+	replacementOrigins := map[int]*PatchOrigin{}
+	var kept []T
+	var keptOrigins []*PatchOrigin
+	keptIndex := map[string]int{}
+	for addedIdx, item := range added {
+		itemName := name(item)
+		var itemOrigin *PatchOrigin
+		if addedIdx < len(origins) {
+			itemOrigin = origins[addedIdx]
+		}
+		origin := r.origin(itemOrigin)
+
+		if otherKind, ok := reserved[itemName]; ok {
+			if origin.Policy != ConflictPolicySkip {
+				return nil, nil, nil, fmt.Errorf(
+					"%s %s of sidecar %s conflicts with the %s of the same name",
+					kind, itemName, origin.Sidecar, otherKind,
+				)
+			}
+			r.warnings = append(r.warnings, fmt.Sprintf(
+				"%s %s of sidecar %s not injected: kept the %s of the same name",
+				kind, itemName, origin.Sidecar, otherKind,
+			))
+			continue
+		}
+
+		if idx, ok := existingIndex[itemName]; ok {
+			switch origin.Policy {
+			case ConflictPolicySkip:
+				r.warnings = append(r.warnings, fmt.Sprintf(
+					"%s %s of sidecar %s not injected: kept the existing %s",
+					kind, itemName, origin.Sidecar, kind,
+				))
+			case ConflictPolicyReplace:
+				if replacements == nil {
+					replacements = map[int]T{}
+				}
+				replacements[idx] = item
+				replacementOrigins[idx] = itemOrigin
+				r.warnings = append(r.warnings, fmt.Sprintf(
+					"existing %s %s replaced by sidecar %s",
+					kind, itemName, origin.Sidecar,
+				))
+			default:
+				return nil, nil, nil, fmt.Errorf(
+					"%s %s of sidecar %s conflicts with an existing %s of the pod",
+					kind, itemName, origin.Sidecar, kind,
+				)
+			}
+			continue
+		}
+
+		if idx, ok := keptIndex[itemName]; ok {
+			switch origin.Policy {
+			case ConflictPolicySkip:
+				r.warnings = append(r.warnings, fmt.Sprintf(
+					"%s %s of sidecar %s not injected: already injected by another sidecar",
+					kind, itemName, origin.Sidecar,
+				))
+			case ConflictPolicyReplace:
+				kept[idx] = item
+				keptOrigins[idx] = itemOrigin
+				r.warnings = append(r.warnings, fmt.Sprintf(
+					"%s %s injected by another sidecar replaced by sidecar %s",
+					kind, itemName, origin.Sidecar,
+				))
+			default:
+				return nil, nil, nil, fmt.Errorf(
+					"%s %s of sidecar %s conflicts with a %s injected by another sidecar",
+					kind, itemName, origin.Sidecar, kind,
+				)
+			}
+			continue
+		}
+
+		keptIndex[itemName] = len(kept)
+		kept = append(kept, item)
+		keptOrigins = append(keptOrigins, itemOrigin)
+	}
+
+	for _, origin := range lo.Flatten([][]*PatchOrigin{keptOrigins, lo.Values(replacementOrigins)}) {
+		if origin != nil {
+			origin.injected = true
+		}
+	}
+
+	return kept, keptOrigins, replacements, nil
+}
+
+// resolveConflicts detects name collisions between the injected items of the PatchConfig
+// and the pod, or between two injected sidecars, and applies the conflict policy of the
+// injected item. Resolved conflicts are returned as warnings, conflicts with the error
+// policy as an error.
+func resolveConflicts(
+	pod *corev1.Pod,
+	config *PatchConfig,
+	defaultPolicy ConflictPolicy,
+) ([]string, error) {
+	r := &conflictResolver{defaultPolicy: defaultPolicy}
+	containerName := func(container corev1.Container) string { return container.Name }
+	// Init containers and containers share their names, but one cannot replace the other.
+	containerNames := func(kind string, containers ...[]corev1.Container) map[string]string {
+		names := map[string]string{}
+		for _, list := range containers {
+			for _, container := range list {
+				names[container.Name] = kind
+			}
+		}
+
+		return names
+	}
+
+	initContainers, initOrigins, initReplacements, err := resolveNamed(
+		r,
+		"initContainer",
+		pod.Spec.InitContainers,
+		containerNames("container", pod.Spec.Containers),
+		config.InitContainers,
+		config.Origins.InitContainers,
+		containerName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	containers, containerOrigins, containerReplacements, err := resolveNamed(
+		r,
+		"container",
+		pod.Spec.Containers,
+		containerNames("initContainer", pod.Spec.InitContainers, initContainers),
+		config.Containers,
+		config.Origins.Containers,
+		containerName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	volumes, volumeOrigins, volumeReplacements, err := resolveNamed(
+		r,
+		"volume",
+		pod.Spec.Volumes,
+		nil,
+		config.Volumes,
+		config.Origins.Volumes,
+		func(volume corev1.Volume) string { return volume.Name },
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	config.InitContainers, config.Origins.InitContainers = initContainers, initOrigins
+	config.Containers, config.Origins.Containers = containers, containerOrigins
+	config.Volumes, config.Origins.Volumes = volumes, volumeOrigins
+	config.Replacements.InitContainers = initReplacements
+	config.Replacements.Containers = containerReplacements
+	config.Replacements.Volumes = volumeReplacements
+
+	// The mounts of a replaced container are those of its replacement.
+	for _, container := range replacedContainers(pod.Spec.Containers, containerReplacements) {
+		added, ok := config.ContainerVolumeMounts[container.Name]
+		if !ok {
+			continue
+		}
+		// Volume mounts conflict on their mount path within one container.
+		mounts, mountOrigins, mountReplacements, err := resolveNamed(
+			r,
+			"volumeMount",
+			container.VolumeMounts,
+			nil,
+			added,
+			config.Origins.VolumeMounts[container.Name],
+			func(mount corev1.VolumeMount) string { return container.Name + ":" + mount.MountPath },
+		)
+		if err != nil {
+			return nil, err
+		}
+		config.ContainerVolumeMounts[container.Name] = mounts
+		config.Origins.VolumeMounts[container.Name] = mountOrigins
+		if len(mountReplacements) > 0 {
+			if config.Replacements.VolumeMounts == nil {
+				config.Replacements.VolumeMounts = map[string]map[int]corev1.VolumeMount{}
+			}
+			config.Replacements.VolumeMounts[container.Name] = mountReplacements
+		}
+	}
+
+	return r.warnings, nil
+}
@@ -0,0 +1,345 @@
+package inject
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func conflictTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "init", Image: "busybox"},
+			},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx"},
+				{Name: "log-agent", Image: "fluent/fluent-bit:1.0"},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "config"},
+			},
+		},
+	}
+}
+
+func conflictTestSidecar(name string, policy ConflictPolicy, containers ...string) Sidecar {
+	sidecar := Sidecar{
+		Name:           name,
+		ConflictPolicy: policy,
+		Volumes:        []corev1.Volume{{Name: "config"}},
+	}
+	for _, container := range containers {
+		sidecar.Containers = append(sidecar.Containers, corev1.Container{
+			Name:  container,
+			Image: name + ":2.0",
+		})
+	}
+
+	return sidecar
+}
+
+// applyConflictTestPatch resolves the conflicts of the sidecars and applies the patch.
+func applyConflictTestPatch(
+	defaultPolicy ConflictPolicy,
+	sidecars ...Sidecar,
+) (*corev1.Pod, []string, error) {
+	pod := conflictTestPod()
+	config := &PatchConfig{}
+	for _, sidecar := range sidecars {
+		config.AddSidecar(sidecar, pod.Spec.Containers)
+	}
+
+	warnings, err := resolveConflicts(pod, config, defaultPolicy)
+	if err != nil {
+		return nil, warnings, err
+	}
+	patchBytes, err := createPatch(pod, config)
+	if err != nil {
+		return nil, warnings, err
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, warnings, err
+	}
+	podBytes, _ := json.Marshal(pod)
+	mutated, err := patch.Apply(podBytes)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	var mutatedPod corev1.Pod
+	err = json.Unmarshal(mutated, &mutatedPod)
+
+	return &mutatedPod, warnings, err
+}
+
+func containerImages(containers []corev1.Container) map[string]string {
+	images := map[string]string{}
+	for _, container := range containers {
+		images[container.Name] = container.Image
+	}
+
+	return images
+}
+
+func TestConflictPolicyError(t *testing.T) {
+	_, _, err := applyConflictTestPatch(
+		ConflictPolicyError,
+		conflictTestSidecar("log-agent", "", "log-agent"),
+	)
+	assert.EqualError(t, err, "container log-agent of sidecar log-agent conflicts with an existing container of the pod")
+
+	_, _, err = applyConflictTestPatch(
+		ConflictPolicySkip,
+		conflictTestSidecar("metrics-agent", ConflictPolicyError, "init"),
+	)
+	assert.EqualError(t, err, "container init of sidecar metrics-agent conflicts with the initContainer of the same name")
+}
+
+func TestConflictPolicySkip(t *testing.T) {
+	pod, warnings, err := applyConflictTestPatch(
+		ConflictPolicyError,
+		conflictTestSidecar("log-agent", ConflictPolicySkip, "log-agent", "log-shipper"),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		"app":         "nginx",
+		"log-agent":   "fluent/fluent-bit:1.0",
+		"log-shipper": "log-agent:2.0",
+	}, containerImages(pod.Spec.Containers))
+	assert.Len(t, pod.Spec.Volumes, 1)
+	assert.Equal(t, []string{
+		"container log-agent of sidecar log-agent not injected: kept the existing container",
+		"volume config of sidecar log-agent not injected: kept the existing volume",
+	}, warnings)
+}
+
+func TestConflictPolicyReplace(t *testing.T) {
+	pod, warnings, err := applyConflictTestPatch(
+		ConflictPolicyReplace,
+		conflictTestSidecar("log-agent", "", "log-agent"),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"app", "log-agent"}, []string{pod.Spec.Containers[0].Name, pod.Spec.Containers[1].Name})
+	assert.Equal(t, map[string]string{
+		"app":       "nginx",
+		"log-agent": "log-agent:2.0",
+	}, containerImages(pod.Spec.Containers))
+	assert.Equal(t, []string{
+		"existing container log-agent replaced by sidecar log-agent",
+		"existing volume config replaced by sidecar log-agent",
+	}, warnings)
+}
+
+func TestConflictPolicyReplaceEnvAndMounts(t *testing.T) {
+	// The env vars of the config annotation and the volume mounts of the sidecar are merged
+	// into the replacement container, not into the container it replaces.
+	pod := conflictTestPod()
+	pod.Spec.Containers[1].Env = []corev1.EnvVar{{Name: "OLD", Value: "old"}}
+	pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/etc/old"}}
+	sidecar := conflictTestSidecar("log-agent", ConflictPolicyReplace, "log-agent")
+	sidecar.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}}
+	sidecar.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/etc/log-agent"}}
+	sidecar.VolumeMounts = []SidecarVolumeMount{
+		{VolumeMount: corev1.VolumeMount{Name: "config", MountPath: "/etc/log-agent", ReadOnly: true}},
+	}
+	config := &PatchConfig{
+		EnvInjections: []EnvInjection{{
+			Source: "ConfigMap dummy/test-config",
+			Envs:   []corev1.EnvVar{{Name: "REGION", Value: "eu"}},
+		}},
+	}
+	config.AddSidecar(sidecar, pod.Spec.Containers)
+
+	warnings, err := resolveConflicts(pod, config, ConflictPolicyError)
+	if !assert.NoError(t, err) {
+		return
+	}
+	envWarnings, err := resolveEnvs(pod, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	patchBytes, err := createPatch(pod, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if !assert.NoError(t, err) {
+		return
+	}
+	podBytes, _ := json.Marshal(pod)
+	mutated, err := patch.Apply(podBytes)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var mutatedPod corev1.Pod
+	if !assert.NoError(t, json.Unmarshal(mutated, &mutatedPod)) {
+		return
+	}
+
+	assert.Equal(t, []string{
+		"existing container log-agent replaced by sidecar log-agent",
+		"existing volume config replaced by sidecar log-agent",
+		"existing volumeMount log-agent:/etc/log-agent replaced by sidecar log-agent",
+	}, append(warnings, envWarnings...))
+	app, agent := mutatedPod.Spec.Containers[0], mutatedPod.Spec.Containers[1]
+	assert.Equal(t, []corev1.EnvVar{{Name: "REGION", Value: "eu"}}, app.Env)
+	assert.Equal(t, "log-agent:2.0", agent.Image)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "LOG_LEVEL", Value: "info"},
+		{Name: "REGION", Value: "eu"},
+	}, agent.Env)
+	assert.Equal(t, []corev1.VolumeMount{
+		{Name: "config", MountPath: "/etc/log-agent", ReadOnly: true},
+	}, agent.VolumeMounts)
+}
+
+func TestConflictBetweenSidecars(t *testing.T) {
+	first := conflictTestSidecar("first", "", "shipper")
+	first.Volumes = nil
+	second := conflictTestSidecar("second", "", "shipper")
+	second.Volumes = nil
+
+	_, _, err := applyConflictTestPatch(ConflictPolicyError, first, second)
+	assert.EqualError(t, err, "container shipper of sidecar second conflicts with a container injected by another sidecar")
+
+	second.ConflictPolicy = ConflictPolicyReplace
+	pod, warnings, err := applyConflictTestPatch(ConflictPolicyError, first, second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, pod.Spec.Containers, 3)
+	assert.Equal(t, "second:2.0", containerImages(pod.Spec.Containers)["shipper"])
+	assert.Equal(t, []string{"container shipper injected by another sidecar replaced by sidecar second"}, warnings)
+}
+
+func TestConflictOriginsPerSidecar(t *testing.T) {
+	// Both sidecars inject the log-agent container, each one is judged by its own policy.
+	first := conflictTestSidecar("first", ConflictPolicySkip, "log-agent")
+	first.Volumes = nil
+	second := conflictTestSidecar("second", ConflictPolicyReplace, "log-agent")
+	second.Volumes = nil
+
+	pod, warnings, err := applyConflictTestPatch(ConflictPolicyError, first, second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "second:2.0", containerImages(pod.Spec.Containers)["log-agent"])
+	assert.Equal(t, []string{
+		"container log-agent of sidecar first not injected: kept the existing container",
+		"existing container log-agent replaced by sidecar second",
+	}, warnings)
+
+	pod = conflictTestPod()
+	config := &PatchConfig{}
+	firstOrigin := config.AddSidecar(first, pod.Spec.Containers)
+	secondOrigin := config.AddSidecar(second, pod.Spec.Containers)
+	_, err = resolveConflicts(pod, config, ConflictPolicyError)
+	if assert.NoError(t, err) {
+		assert.True(t, firstOrigin.dropped(), "all the items of the first sidecar are skipped")
+		assert.False(t, secondOrigin.dropped())
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy(" Replace ")
+	assert.NoError(t, err)
+	assert.Equal(t, ConflictPolicyReplace, policy)
+
+	_, err = ParseConflictPolicy("merge")
+	assert.Error(t, err)
+
+	var sidecars []Sidecar
+	err = yaml.Unmarshal([]byte("- name: log-agent\n  conflictPolicy: Skip\n"), &sidecars)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ConflictPolicySkip, sidecars[0].ConflictPolicy)
+	}
+	err = yaml.Unmarshal([]byte("- name: log-agent\n  conflictPolicy: merge\n"), &sidecars)
+	assert.ErrorContains(t, err, `sidecar log-agent: invalid conflict policy "merge"`)
+}
+
+func TestConflictPolicyAdmission(t *testing.T) {
+	// The pod has the volume of the sidecar but a differently named container, the sidecar
+	// is not present and the conflict policy applies to the volume.
+	req, err := newTestAdmissionRequest("./testdata/sidecar-present-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	admissionReq, err := NewAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var original corev1.Pod
+	if !assert.NoError(t, json.Unmarshal(admissionReq.Object.Raw, &original)) {
+		return
+	}
+	original.Spec.Containers[2].Name = "other-agent"
+	if admissionReq.Object.Raw, err = json.Marshal(original); !assert.NoError(t, err) {
+		return
+	}
+	admit := func(policy ConflictPolicy) admissionv1.AdmissionResponse {
+		injectorConfig := testInjectorConfig()
+		injectorConfig.ConflictPolicy = policy
+
+		return newTestWebhookServer().HandleAdmissionRequest(injectorConfig, admissionReq, context.Background())
+	}
+
+	resp := admit(ConflictPolicyError)
+	assert.False(t, resp.Allowed)
+	assert.Equal(
+		t,
+		"Conflicting sidecar injection: volume agent-conf of sidecar haystack-agent conflicts with an "+
+			"existing volume of the pod",
+		resp.Result.Message,
+	)
+
+	mutatedPod := func(resp admissionv1.AdmissionResponse) *corev1.Pod {
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		mutated, err := patch.Apply(admissionReq.Object.Raw)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var pod corev1.Pod
+		if !assert.NoError(t, json.Unmarshal(mutated, &pod)) {
+			return nil
+		}
+
+		return &pod
+	}
+
+	resp = admit(ConflictPolicySkip)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"volume agent-conf of sidecar haystack-agent not injected: kept the existing volume",
+	}, resp.Warnings)
+	if pod := mutatedPod(resp); pod != nil {
+		assert.Len(t, pod.Spec.Containers, 4)
+		assert.Len(t, pod.Spec.Volumes, 2)
+		assert.Contains(t, pod.Annotations["injector.server-lab.info/status"], `"source":"dummy/sidecar-config"`)
+	}
+
+	resp = admit(ConflictPolicyReplace)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"existing volume agent-conf replaced by sidecar haystack-agent",
+	}, resp.Warnings)
+	if pod := mutatedPod(resp); pod != nil {
+		assert.Len(t, pod.Spec.Containers, 4)
+		assert.Len(t, pod.Spec.Volumes, 2)
+		assert.Contains(t, pod.Annotations["injector.server-lab.info/status"], `"source":"dummy/sidecar-config"`)
+	}
+}
@@ -0,0 +1,197 @@
+package inject
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// envMergeSuffix is the suffix of an env annotation overriding the merge strategy of a
+// pod, e.g. "<prefix>/config-merge: keep-existing".
+const envMergeSuffix = "-merge"
+
+// EnvMergeStrategy decides what happens when an injected env var has the name of an env
+// var the container already defines.
+type EnvMergeStrategy string
+
+const (
+	// EnvMergeKeepExisting keeps the env var of the container.
+	EnvMergeKeepExisting EnvMergeStrategy = "keep-existing"
+	// EnvMergeOverride replaces the env var of the container with the injected one.
+	EnvMergeOverride EnvMergeStrategy = "override"
+	// EnvMergeFail denies the pod.
+	EnvMergeFail EnvMergeStrategy = "fail"
+)
+
+// ParseEnvMergeStrategy validates an env merge strategy name.
+func ParseEnvMergeStrategy(value string) (EnvMergeStrategy, error) {
+	switch strategy := EnvMergeStrategy(strings.ToLower(strings.TrimSpace(value))); strategy {
+	case EnvMergeKeepExisting, EnvMergeOverride, EnvMergeFail:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid env merge strategy %q, expecting one of %s, %s, %s",
+			value,
+			EnvMergeKeepExisting,
+			EnvMergeOverride,
+			EnvMergeFail,
+		)
+	}
+}
+
+// getEnvMergeStrategy returns the merge strategy of the pod annotation of the env
+// annotation name, else the global one.
+func getEnvMergeStrategy(
+	metadata *metav1.ObjectMeta,
+	injectorConfig InjectorConfig,
+	name string,
+) (EnvMergeStrategy, error) {
+	strategy := injectorConfig.EnvMergeStrategy
+	if strategy == "" {
+		strategy = EnvMergeOverride
+	}
+
+	value, err := getAnnotation(metadata, name+envMergeSuffix, injectorConfig.InjectPrefix)
+	if err != nil {
+		return strategy, nil
+	}
+	annotated, err := ParseEnvMergeStrategy(value)
+	if err != nil {
+		return strategy, err
+	}
+
+	return annotated, nil
+}
+
+// ContainerEnv is the env and envFrom of one container after the env injections. A nil
+// list is left untouched by the patch.
+type ContainerEnv struct {
+	Env     []corev1.EnvVar
+	EnvFrom []corev1.EnvFromSource
+}
+
+// mergeEnvs merges the env injections selecting the container into its env. Collisions
+// with the env of the container follow the merge strategy of the injection, collisions
+// between two injections are won by the later one. Overridden env vars keep their place,
+// new ones are inserted before the env vars referencing them, see orderEnvs.
+func mergeEnvs(
+	container corev1.Container,
+	injections []EnvInjection,
+	init bool,
+) (ContainerEnv, []string, error) {
+	var result ContainerEnv
+	var warnings []string
+
+	final := append([]corev1.EnvVar{}, container.Env...)
+	index := map[string]int{}
+	// origins maps the injected env vars to their source, existing ones are not listed.
+	origins := map[string]string{}
+	for idx, env := range final {
+		index[env.Name] = idx
+	}
+
+	added := false
+	for _, injection := range injections {
+		if (init && !injection.Targets.IncludeInit) || !injection.Targets.Selects(container.Name) {
+			continue
+		}
+		result.EnvFrom = append(result.EnvFrom, injection.EnvFrom...)
+
+		for _, env := range injection.Envs {
+			idx, exists := index[env.Name]
+			if !exists {
+				index[env.Name] = len(final)
+				origins[env.Name] = injection.Source
+				final = append(final, env)
+				added = true
+				continue
+			}
+
+			if previous, injected := origins[env.Name]; injected {
+				warnings = append(warnings, fmt.Sprintf(
+					"env var %s of %s overridden by %s in container %s",
+					env.Name, previous, injection.Source, container.Name,
+				))
+				final[idx] = env
+				origins[env.Name] = injection.Source
+				continue
+			}
+
+			switch injection.Merge {
+			case EnvMergeKeepExisting:
+				warnings = append(warnings, fmt.Sprintf(
+					"env var %s of %s not injected into container %s: kept the existing value",
+					env.Name, injection.Source, container.Name,
+				))
+			case EnvMergeFail:
+				return ContainerEnv{}, warnings, fmt.Errorf(
+					"env var %s of %s conflicts with an existing env var of container %s",
+					env.Name, injection.Source, container.Name,
+				)
+			default:
+				warnings = append(warnings, fmt.Sprintf(
+					"existing env var %s of container %s overridden by %s",
+					env.Name, container.Name, injection.Source,
+				))
+				final[idx] = env
+				origins[env.Name] = injection.Source
+				added = true
+			}
+		}
+	}
+
+	if added {
+		var cycle []string
+		result.Env, cycle = orderEnvs(final[:len(container.Env)], final[len(container.Env):])
+		if len(cycle) > 0 {
+			warnings = append(warnings, envCycleWarning(container.Name, cycle))
+		}
+	}
+	if result.EnvFrom != nil {
+		result.EnvFrom = append(append([]corev1.EnvFromSource{}, container.EnvFrom...), result.EnvFrom...)
+	}
+
+	return result, warnings, nil
+}
+
+// resolveEnvs merges the env injections of the PatchConfig into the env of the pod
+// containers and init containers, as they are after the conflict replacements. Collisions are returned as warnings, collisions under
+// the fail strategy as an error.
+func resolveEnvs(pod *corev1.Pod, config *PatchConfig) ([]string, error) {
+	var warnings []string
+
+	resolve := func(containers []corev1.Container, init bool) (map[int]ContainerEnv, error) {
+		var resolved map[int]ContainerEnv
+		for idx, container := range containers {
+			env, envWarnings, err := mergeEnvs(container, config.EnvInjections, init)
+			warnings = append(warnings, envWarnings...)
+			if err != nil {
+				return nil, err
+			}
+			if env.Env == nil && env.EnvFrom == nil {
+				continue
+			}
+			if resolved == nil {
+				resolved = map[int]ContainerEnv{}
+			}
+			resolved[idx] = env
+		}
+
+		return resolved, nil
+	}
+
+	var err error
+	if config.ContainerEnvs, err = resolve(replacedContainers(pod.Spec.Containers, config.Replacements.Containers), false); err != nil {
+		return warnings, err
+	}
+	if config.InitContainerEnvs, err = resolve(
+		replacedContainers(pod.Spec.InitContainers, config.Replacements.InitContainers),
+		true,
+	); err != nil {
+		return warnings, err
+	}
+
+	return warnings, nil
+}
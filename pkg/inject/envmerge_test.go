@@ -0,0 +1,209 @@
+package inject
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func envMergeTestContainer() corev1.Container {
+	return corev1.Container{
+		Name: "app",
+		Env: []corev1.EnvVar{
+			{Name: "LOG_LEVEL", Value: "debug"},
+			{Name: "PORT", Value: "8080"},
+		},
+	}
+}
+
+func envMergeTestInjection(source string, merge EnvMergeStrategy, envs ...corev1.EnvVar) EnvInjection {
+	return EnvInjection{Source: source, Envs: envs, Merge: merge}
+}
+
+func TestMergeEnvsOverride(t *testing.T) {
+	env, warnings, err := mergeEnvs(envMergeTestContainer(), []EnvInjection{
+		envMergeTestInjection(
+			"ConfigMap defaults",
+			EnvMergeOverride,
+			corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"},
+			corev1.EnvVar{Name: "REGION", Value: "eu"},
+		),
+	}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "LOG_LEVEL", Value: "info"},
+		{Name: "PORT", Value: "8080"},
+		{Name: "REGION", Value: "eu"},
+	}, env.Env)
+	assert.Equal(t, []string{
+		"existing env var LOG_LEVEL of container app overridden by ConfigMap defaults",
+	}, warnings)
+}
+
+func TestMergeEnvsKeepExisting(t *testing.T) {
+	env, warnings, err := mergeEnvs(envMergeTestContainer(), []EnvInjection{
+		envMergeTestInjection(
+			"ConfigMap defaults",
+			EnvMergeKeepExisting,
+			corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"},
+		),
+	}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, env.Env)
+	assert.Equal(t, []string{
+		"env var LOG_LEVEL of ConfigMap defaults not injected into container app: kept the existing value",
+	}, warnings)
+}
+
+func TestMergeEnvsFail(t *testing.T) {
+	_, _, err := mergeEnvs(envMergeTestContainer(), []EnvInjection{
+		envMergeTestInjection(
+			"Secret credentials",
+			EnvMergeFail,
+			corev1.EnvVar{Name: "REGION", Value: "eu"},
+			corev1.EnvVar{Name: "PORT", Value: "9090"},
+		),
+	}, false)
+	assert.EqualError(t, err, "env var PORT of Secret credentials conflicts with an existing env var of container app")
+}
+
+func TestMergeEnvsBetweenInjections(t *testing.T) {
+	env, warnings, err := mergeEnvs(envMergeTestContainer(), []EnvInjection{
+		envMergeTestInjection("ConfigMap defaults", EnvMergeFail, corev1.EnvVar{Name: "REGION", Value: "eu"}),
+		envMergeTestInjection("ConfigMap overrides", EnvMergeFail, corev1.EnvVar{Name: "REGION", Value: "us"}),
+	}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, env.Env, corev1.EnvVar{Name: "REGION", Value: "us"})
+	assert.Len(t, env.Env, 3)
+	assert.Equal(t, []string{
+		"env var REGION of ConfigMap defaults overridden by ConfigMap overrides in container app",
+	}, warnings)
+
+	env, _, err = mergeEnvs(envMergeTestContainer(), []EnvInjection{
+		envMergeTestInjection("ConfigMap defaults", EnvMergeOverride, corev1.EnvVar{Name: "REGION", Value: "eu"}),
+	}, true)
+	assert.NoError(t, err)
+	assert.Nil(t, env.Env, "init containers need include-init")
+}
+
+func TestParseEnvMergeStrategy(t *testing.T) {
+	strategy, err := ParseEnvMergeStrategy("Keep-Existing")
+	assert.NoError(t, err)
+	assert.Equal(t, EnvMergeKeepExisting, strategy)
+
+	_, err = ParseEnvMergeStrategy("append")
+	assert.Error(t, err)
+}
+
+func envNames(envs []corev1.EnvVar) []string {
+	names := make([]string, 0, len(envs))
+	for _, env := range envs {
+		names = append(names, env.Name)
+	}
+
+	return names
+}
+
+func TestOrderEnvs(t *testing.T) {
+	var testCases = []struct {
+		description   string
+		envs          []corev1.EnvVar
+		added         []corev1.EnvVar
+		expectedOrder []string
+		expectedCycle []string
+	}{
+		{
+			description:   "Container order is kept",
+			envs:          []corev1.EnvVar{{Name: "ZONE", Value: "a"}, {Name: "APP", Value: "web"}},
+			added:         []corev1.EnvVar{{Name: "BACKEND", Value: "api"}},
+			expectedOrder: []string{"ZONE", "APP", "BACKEND"},
+		},
+		{
+			description: "Added env var referenced by the container",
+			envs: []corev1.EnvVar{
+				{Name: "PORT", Value: "8080"},
+				{Name: "URL", Value: "http://$(DB_HOST):5432"},
+			},
+			added:         []corev1.EnvVar{{Name: "DB_HOST", Value: "db"}},
+			expectedOrder: []string{"PORT", "DB_HOST", "URL"},
+		},
+		{
+			description: "Container env vars referencing each other do not move",
+			envs: []corev1.EnvVar{
+				{Name: "A", Value: "$(X)"},
+				{Name: "B", Value: "b"},
+				{Name: "C", Value: "$(A)/c"},
+			},
+			added:         []corev1.EnvVar{{Name: "X", Value: "x"}},
+			expectedOrder: []string{"X", "A", "B", "C"},
+		},
+		{
+			description: "Indirect reference",
+			envs: []corev1.EnvVar{
+				{Name: "PORT", Value: "8080"},
+				{Name: "URL", Value: "http://$(DB_ADDRESS)"},
+			},
+			added: []corev1.EnvVar{
+				{Name: "DB_HOST", Value: "db"},
+				{Name: "DB_ADDRESS", Value: "$(DB_HOST):5432"},
+			},
+			expectedOrder: []string{"PORT", "DB_HOST", "DB_ADDRESS", "URL"},
+		},
+		{
+			description: "Added env vars referencing each other",
+			added: []corev1.EnvVar{
+				{Name: "DSN", Value: "$(USER)@$(HOST)"},
+				{Name: "HOST", Value: "db"},
+				{Name: "USER", Value: "app"},
+			},
+			expectedOrder: []string{"HOST", "USER", "DSN"},
+		},
+		{
+			description: "Escaped and container only references",
+			envs: []corev1.EnvVar{
+				{Name: "A", Value: "$(B)"},
+				{Name: "LITERAL", Value: "$$(HOST)"},
+				{Name: "B", Value: "b"},
+			},
+			added:         []corev1.EnvVar{{Name: "HOST", Value: "db"}},
+			expectedOrder: []string{"A", "LITERAL", "B", "HOST"},
+		},
+		{
+			description: "Cycle",
+			envs:        []corev1.EnvVar{{Name: "FIRST", Value: "1"}, {Name: "LAST", Value: "2"}},
+			added: []corev1.EnvVar{
+				{Name: "A", Value: "$(B)"},
+				{Name: "B", Value: "$(A)"},
+			},
+			expectedOrder: []string{"FIRST", "LAST", "A", "B"},
+			expectedCycle: []string{"A", "B"},
+		},
+		{
+			description:   "Cycle through the container",
+			envs:          []corev1.EnvVar{{Name: "A", Value: "$(X)"}},
+			added:         []corev1.EnvVar{{Name: "X", Value: "$(A)"}},
+			expectedOrder: []string{"X", "A"},
+			expectedCycle: []string{"X", "A"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			ordered, cycle := orderEnvs(tc.envs, tc.added)
+			assert.Equal(t, tc.expectedOrder, envNames(ordered))
+			assert.Equal(t, tc.expectedCycle, cycle)
+		})
+	}
+}
+
+func TestEnvReferences(t *testing.T) {
+	assert.Equal(t, []string{"HOST", "PORT"}, envReferences(corev1.EnvVar{Value: "$(HOST):$(PORT)/$$(ESCAPED)$"}))
+	assert.Empty(t, envReferences(corev1.EnvVar{Value: "$(UNTERMINATED"}))
+}
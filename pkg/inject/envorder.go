@@ -0,0 +1,168 @@
+package inject
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// envReferences returns the names of the $(VAR) references of the env var value, "$$" is
+// the escape of "$" as in the Kubernetes expansion.
+func envReferences(env corev1.EnvVar) []string {
+	var refs []string
+
+	value := env.Value
+	for len(value) > 0 {
+		idx := strings.IndexByte(value, '$')
+		if idx < 0 || idx+1 >= len(value) {
+			break
+		}
+		switch value[idx+1] {
+		case '$':
+			value = value[idx+2:]
+		case '(':
+			end := strings.IndexByte(value[idx+2:], ')')
+			if end < 0 {
+				return refs
+			}
+			refs = append(refs, value[idx+2:idx+2+end])
+			value = value[idx+2+end+1:]
+		default:
+			value = value[idx+1:]
+		}
+	}
+
+	return refs
+}
+
+// orderEnvs inserts the env vars added to the container env so that Kubernetes can
+// expand the $(VAR) references to them: each added env var is placed right before the
+// first env var of the container referencing it, directly or indirectly, else at the end.
+// The env vars of the container never move. The names of the env vars whose references
+// to or from an added env var still cannot be expanded, e.g. in a cycle, are returned.
+func orderEnvs(envs []corev1.EnvVar, added []corev1.EnvVar) ([]corev1.EnvVar, []string) {
+	all := append(append([]corev1.EnvVar{}, envs...), added...)
+	index := map[string]int{}
+	for idx, env := range all {
+		index[env.Name] = idx
+	}
+	// refs[i] lists the env vars referenced by all[i].
+	refs := make([][]int, len(all))
+	for idx, env := range all {
+		for _, ref := range envReferences(env) {
+			if refIdx, ok := index[ref]; ok && refIdx != idx {
+				refs[idx] = append(refs[idx], refIdx)
+			}
+		}
+	}
+
+	// before[i] is the position among envs before which added[i] is inserted.
+	before := make([]int, len(added))
+	for idx := range before {
+		before[idx] = len(envs)
+	}
+	for idx := len(envs) - 1; idx >= 0; idx-- {
+		visited := map[int]bool{idx: true}
+		pending := []int{idx}
+		for len(pending) > 0 {
+			current := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			for _, ref := range refs[current] {
+				if visited[ref] {
+					continue
+				}
+				visited[ref] = true
+				pending = append(pending, ref)
+				if ref >= len(envs) {
+					before[ref-len(envs)] = idx
+				}
+			}
+		}
+	}
+
+	ordered := make([]corev1.EnvVar, 0, len(all))
+	for position := 0; position <= len(envs); position++ {
+		var group []int
+		for idx := range added {
+			if before[idx] == position {
+				group = append(group, len(envs)+idx)
+			}
+		}
+		for _, idx := range orderGroup(group, refs) {
+			ordered = append(ordered, all[idx])
+		}
+		if position < len(envs) {
+			ordered = append(ordered, envs[position])
+		}
+	}
+
+	positions := map[string]int{}
+	for idx, env := range ordered {
+		positions[env.Name] = idx
+	}
+	unexpanded := map[string]bool{}
+	for idx, env := range all {
+		for _, ref := range refs[idx] {
+			if (idx >= len(envs) || ref >= len(envs)) && positions[all[ref].Name] > positions[env.Name] {
+				unexpanded[env.Name] = true
+				unexpanded[all[ref].Name] = true
+			}
+		}
+	}
+	var cycle []string
+	for _, env := range ordered {
+		if unexpanded[env.Name] {
+			cycle = append(cycle, env.Name)
+		}
+	}
+
+	return ordered, cycle
+}
+
+// orderGroup orders the added env vars inserted at the same position so that the
+// referenced ones come first, keeping their order otherwise. Env vars of a reference
+// cycle keep their order after the others.
+func orderGroup(group []int, refs [][]int) []int {
+	members := map[int]bool{}
+	for _, idx := range group {
+		members[idx] = true
+	}
+
+	ordered := make([]int, 0, len(group))
+	placed := map[int]bool{}
+	for len(ordered) < len(group) {
+		next := -1
+		for _, idx := range group {
+			ready := !placed[idx]
+			for _, ref := range refs[idx] {
+				ready = ready && (!members[ref] || placed[ref])
+			}
+			if ready {
+				next = idx
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		placed[next] = true
+		ordered = append(ordered, next)
+	}
+	for _, idx := range group {
+		if !placed[idx] {
+			ordered = append(ordered, idx)
+		}
+	}
+
+	return ordered
+}
+
+// envCycleWarning describes the env vars of a reference cycle of the container.
+func envCycleWarning(container string, cycle []string) string {
+	return fmt.Sprintf(
+		"env vars %s of container %s reference each other through $(...) and cannot all be expanded",
+		strings.Join(cycle, ", "),
+		container,
+	)
+}
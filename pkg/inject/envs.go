@@ -0,0 +1,217 @@
+package inject
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// envModeSuffix is the suffix of an env annotation overriding the env mode of a pod, e.g.
+// "<prefix>/config-mode: envFrom".
+const envModeSuffix = "-mode"
+
+// EnvMode decides how the ConfigMaps and Secrets of the env annotations are injected into
+// containers.
+type EnvMode string
+
+const (
+	// EnvModeValue copies the ConfigMap values into the env vars at admission time.
+	EnvModeValue EnvMode = "value"
+	// EnvModeEnvFrom references the whole ConfigMap or Secret with an envFrom entry.
+	EnvModeEnvFrom EnvMode = "envFrom"
+	// EnvModeKeyRef references every key with a configMapKeyRef or secretKeyRef env var.
+	EnvModeKeyRef EnvMode = "keyRef"
+)
+
+// ParseEnvMode validates an env mode name, ignoring its case.
+func ParseEnvMode(value string) (EnvMode, error) {
+	for _, mode := range []EnvMode{EnvModeValue, EnvModeEnvFrom, EnvModeKeyRef} {
+		if strings.EqualFold(strings.TrimSpace(value), string(mode)) {
+			return mode, nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"invalid env mode %q, expecting one of %s, %s, %s",
+		value,
+		EnvModeValue,
+		EnvModeEnvFrom,
+		EnvModeKeyRef,
+	)
+}
+
+// EnvInjection is a set of env vars injected into the containers selected by Targets.
+type EnvInjection struct {
+	// Source names the ConfigMap or Secret of the env vars in warnings.
+	Source  string
+	Envs    []corev1.EnvVar
+	EnvFrom []corev1.EnvFromSource
+	Targets EnvTargets
+	Merge   EnvMergeStrategy
+}
+
+// getEnvMode returns the env mode of the pod annotation of the env annotation name, else
+// the global one.
+func getEnvMode(metadata *metav1.ObjectMeta, injectorConfig InjectorConfig, name string) (EnvMode, error) {
+	mode := injectorConfig.EnvMode
+	if mode == "" {
+		mode = EnvModeValue
+	}
+
+	value, err := getAnnotation(metadata, name+envModeSuffix, injectorConfig.InjectPrefix)
+	if err != nil {
+		return mode, nil
+	}
+	annotated, err := ParseEnvMode(value)
+	if err != nil {
+		return mode, err
+	}
+
+	return annotated, nil
+}
+
+// envOptions reads the mode, target and merge annotations of the env annotation name
+// into an EnvInjection of source, without env vars yet. Invalid annotations are reported
+// as warnings.
+func envOptions(
+	pod *corev1.Pod,
+	injectorConfig InjectorConfig,
+	name string,
+	source string,
+) (EnvMode, EnvInjection, []string) {
+	var warnings []string
+	injection := EnvInjection{Source: source}
+
+	mode, err := getEnvMode(&pod.ObjectMeta, injectorConfig, name)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("env mode of %s: %v, using %s", source, err, mode))
+	}
+	injection.Merge, err = getEnvMergeStrategy(&pod.ObjectMeta, injectorConfig, name)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf(
+			"env merge strategy of %s: %v, using %s",
+			source,
+			err,
+			injection.Merge,
+		))
+	}
+	injection.Targets, err = getEnvTargets(&pod.ObjectMeta, injectorConfig, name)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("env targets of %s: %v", source, err))
+	}
+	for _, pattern := range injection.Targets.unmatched(pod) {
+		warnings = append(warnings, fmt.Sprintf(
+			"env target %q of %s matches no container of the pod",
+			pattern,
+			source,
+		))
+	}
+
+	return mode, injection, warnings
+}
+
+// EnvNameValidation decides which ConfigMap and Secret keys are valid env var names.
+type EnvNameValidation string
+
+const (
+	// EnvNameStrict accepts C identifiers, the names every shell and tool can consume.
+	EnvNameStrict EnvNameValidation = "strict"
+	// EnvNameRelaxed accepts every name allowed by the Kubernetes API, e.g. "FOO.BAR".
+	EnvNameRelaxed EnvNameValidation = "relaxed"
+)
+
+// ParseEnvNameValidation validates an env name validation mode.
+func ParseEnvNameValidation(value string) (EnvNameValidation, error) {
+	switch validation := EnvNameValidation(strings.ToLower(strings.TrimSpace(value))); validation {
+	case EnvNameStrict, EnvNameRelaxed:
+		return validation, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid env name validation %q, expecting one of %s, %s",
+			value,
+			EnvNameStrict,
+			EnvNameRelaxed,
+		)
+	}
+}
+
+// valid reports whether name is a valid env var name, the zero value validates strictly.
+func (v EnvNameValidation) valid(name string) bool {
+	if v == EnvNameRelaxed {
+		return len(validation.IsEnvVarName(name)) == 0
+	}
+
+	return len(validation.IsCIdentifier(name)) == 0
+}
+
+// rejectedKeyWarnings lists the keys of source skipped by the env name validation.
+func rejectedKeyWarnings(source string, keys []string, v EnvNameValidation) []string {
+	if v == "" {
+		v = EnvNameStrict
+	}
+
+	return lo.Map(keys, func(key string, _ int) string {
+		return fmt.Sprintf("key %q of %s is not a valid env var name under %s validation, not injected", key, source, v)
+	})
+}
+
+// generateEnvs converts the ConfigMap data into env vars named after the key mapping of
+// the source, or one envFrom entry, according to the mode. Keys whose env var name is not
+// valid are returned as invalid: they are left out of the env vars and skipped by the
+// kubelet for envFrom.
+func generateEnvs(
+	cm *corev1.ConfigMap,
+	source envSource,
+	mode EnvMode,
+	validation EnvNameValidation,
+) ([]corev1.EnvVar, []corev1.EnvFromSource, []string) {
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var envs []corev1.EnvVar
+	var invalid []string
+	for _, key := range keys {
+		name := source.envName(key)
+		if !validation.valid(name) {
+			invalid = append(invalid, key)
+			continue
+		}
+
+		switch mode {
+		case EnvModeEnvFrom:
+		case EnvModeKeyRef:
+			envs = append(envs, corev1.EnvVar{
+				Name: name,
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name},
+						Key:                  key,
+					},
+				},
+			})
+		default:
+			envs = append(envs, corev1.EnvVar{Name: name, Value: cm.Data[key]})
+		}
+	}
+
+	if mode == EnvModeEnvFrom {
+		return nil, []corev1.EnvFromSource{
+			{
+				Prefix: source.Prefix,
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name},
+				},
+			},
+		}, invalid
+	}
+
+	return envs, nil, invalid
+}
@@ -0,0 +1,78 @@
+package inject
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// envPrefixOption is the key mapping option prefixing the env var names of a ConfigMap.
+const envPrefixOption = "prefix"
+
+// envSource is one entry of the config annotation, "name[:option;option...]" where an
+// option is either "KEY=ENV_NAME", injecting the KEY of the ConfigMap as ENV_NAME, or
+// "prefix=PREFIX", prepended to the names of the keys which are not mapped.
+type envSource struct {
+	Name string
+	// Keys maps ConfigMap keys to env var names.
+	Keys   map[string]string
+	Prefix string
+}
+
+// envName returns the env var name of the ConfigMap key.
+func (s envSource) envName(key string) string {
+	if name, ok := s.Keys[key]; ok {
+		return name
+	}
+
+	return s.Prefix + key
+}
+
+// parseEnvSources parses the config annotation, a comma separated list of env sources in
+// increasing precedence. Invalid options are returned as an error next to the sources.
+func parseEnvSources(value string) ([]envSource, error) {
+	var errs []string
+
+	sources := lo.FilterMap(splitList(value), func(entry string, _ int) (envSource, bool) {
+		name, options, _ := strings.Cut(entry, ":")
+		source := envSource{Name: strings.TrimSpace(name)}
+		if source.Name == "" {
+			errs = append(errs, fmt.Sprintf("missing ConfigMap name in %q", entry))
+			return source, false
+		}
+
+		for _, option := range strings.Split(options, ";") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			key, envName, ok := strings.Cut(option, "=")
+			key, envName = strings.TrimSpace(key), strings.TrimSpace(envName)
+			switch {
+			case !ok || key == "" || envName == "":
+				errs = append(errs, fmt.Sprintf(
+					"invalid option %q of ConfigMap %s, expecting KEY=NAME or %s=PREFIX",
+					option,
+					source.Name,
+					envPrefixOption,
+				))
+			case key == envPrefixOption:
+				source.Prefix = envName
+			default:
+				if source.Keys == nil {
+					source.Keys = map[string]string{}
+				}
+				source.Keys[key] = envName
+			}
+		}
+
+		return source, true
+	})
+
+	if len(errs) > 0 {
+		return sources, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return sources, nil
+}
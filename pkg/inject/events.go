@@ -0,0 +1,176 @@
+package inject
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component of the Events recorded by the webhook.
+const eventComponent = "k8-injector"
+
+// Event reasons recorded by the webhook.
+const (
+	// ReasonInvalidEnvKeys is recorded on a ConfigMap or Secret whose keys are skipped by
+	// the env name validation.
+	ReasonInvalidEnvKeys = "InvalidEnvKeys"
+	// ReasonInjected is recorded on the sources and the workload of an admitted pod.
+	ReasonInjected = "Injected"
+	// ReasonSourceNotFound is recorded on the workload of a pod referencing a missing
+	// ConfigMap or Secret.
+	ReasonSourceNotFound = "SourceNotFound"
+	// ReasonSourceFetchFailed is recorded on the workload when a source cannot be fetched.
+	ReasonSourceFetchFailed = "SourceFetchFailed"
+	// ReasonParseFailed is recorded on a ConfigMap whose sidecars cannot be rendered or
+	// decoded, and on the workload referencing it.
+	ReasonParseFailed = "ParseFailed"
+)
+
+// Default rate limits of the Events recorded about one object. A burst of Events is
+// accepted, then one Event per minute, so that a crash-looping ReplicaSet recreating its
+// pods does not flood the apiserver.
+const (
+	DefaultEventBurst = 10
+	DefaultEventQPS   = 1. / 60.
+)
+
+// NewEventRecorder creates an EventRecorder writing Events through the client. Events about
+// one object are rate limited to burst Events, then qps Events per second, and similar
+// Events are aggregated. The returned function stops the recording.
+func NewEventRecorder(client kubernetes.Interface, qps float32, burst int) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		QPS:       qps,
+		BurstSize: burst,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+
+	return recorder, broadcaster.Shutdown
+}
+
+// workloadReference returns the controller of the pod, the pod itself does not exist yet
+// at admission. Events are recorded on the controller reference as is, e.g. the ReplicaSet
+// of a Deployment pod, so that the admission does not read the apiserver. Pods without
+// controller have no workload.
+func workloadReference(pod *corev1.Pod, namespace string) *corev1.ObjectReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
+
+// injectedSource is a ConfigMap, Secret or SidecarTemplate contributing to the pod.
+type injectedSource struct {
+	object runtime.Object
+	name   string
+	items  []string
+}
+
+// injectionEvents records the Events of one admission on the referenced sources and on the
+// owning workload. Failures are recorded right away, injections once the pod is admitted.
+type injectionEvents struct {
+	recorder record.EventRecorder
+	pod      string
+	workload *corev1.ObjectReference
+	sources  []*injectedSource
+}
+
+// newInjectionEvents returns the Events of the admission of pod, which do nothing when the
+// server has no Recorder or the request is a dry run, which must not have side effects.
+func (whsvr *WebhookServer) newInjectionEvents(pod *corev1.Pod, namespace string, dryRun bool) *injectionEvents {
+	events := &injectionEvents{
+		pod:      namespace + "/" + metaName(&pod.ObjectMeta),
+		workload: workloadReference(pod, namespace),
+	}
+	if !dryRun {
+		events.recorder = whsvr.Recorder
+	}
+
+	return events
+}
+
+// warningf records a warning Event on object, when set, and on the workload.
+func (e *injectionEvents) warningf(object runtime.Object, reason string, messageFmt string, args ...interface{}) {
+	if e.recorder == nil {
+		return
+	}
+	if object != nil {
+		e.recorder.Eventf(object, corev1.EventTypeWarning, reason, messageFmt, args...)
+	}
+	if e.workload != nil {
+		e.recorder.Eventf(e.workload, corev1.EventTypeWarning, reason, messageFmt, args...)
+	}
+}
+
+// rejectedKeys records a warning Event on the ConfigMap or Secret whose keys are skipped by
+// the env name validation of the pod.
+func (e *injectionEvents) rejectedKeys(object runtime.Object, keys []string, validation EnvNameValidation) {
+	if e.recorder == nil || len(keys) == 0 {
+		return
+	}
+	if validation == "" {
+		validation = EnvNameStrict
+	}
+
+	e.recorder.Eventf(
+		object,
+		corev1.EventTypeWarning,
+		ReasonInvalidEnvKeys,
+		"Keys %s are not valid env var names under %s validation and were not injected into pod %s",
+		strings.Join(keys, ", "),
+		validation,
+		e.pod,
+	)
+}
+
+// injected records that item, e.g. "sidecar log-agent", of the named source is injected.
+// Sources without object, like SidecarTemplates, are only reported on the workload.
+func (e *injectionEvents) injected(object runtime.Object, name string, item string) {
+	for _, source := range e.sources {
+		if source.name == name {
+			source.items = append(source.items, item)
+			return
+		}
+	}
+	e.sources = append(e.sources, &injectedSource{object: object, name: name, items: []string{item}})
+}
+
+// admitted records the Injected Events of the admitted pod.
+func (e *injectionEvents) admitted() {
+	if e.recorder == nil || len(e.sources) == 0 {
+		return
+	}
+
+	summary := make([]string, 0, len(e.sources))
+	for _, source := range e.sources {
+		items := strings.Join(source.items, ", ")
+		if source.object != nil {
+			e.recorder.Eventf(source.object, corev1.EventTypeNormal, ReasonInjected, "Injected %s into pod %s", items, e.pod)
+		}
+		summary = append(summary, items+" of "+source.name)
+	}
+	if e.workload != nil {
+		e.recorder.Eventf(
+			e.workload,
+			corev1.EventTypeNormal,
+			ReasonInjected,
+			"Injected %s into pod %s",
+			strings.Join(summary, "; "),
+			e.pod,
+		)
+	}
+}
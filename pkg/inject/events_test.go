@@ -0,0 +1,72 @@
+package inject
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestEventRecorderRateLimit(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder, shutdown := NewEventRecorder(client, 1./3600., 2)
+	defer shutdown()
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "dummy", Name: "test-config", UID: "uid"}}
+	for i := 0; i < 5; i++ {
+		recorder.Eventf(configMap, corev1.EventTypeWarning, ReasonInvalidEnvKeys, "Keys K%d are not valid", i)
+	}
+
+	createdEvents := func() int {
+		return len(lo.Filter(client.Actions(), func(action k8stesting.Action, _ int) bool {
+			return action.Matches("create", "events")
+		}))
+	}
+	assert.Eventually(t, func() bool { return createdEvents() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Never(t, func() bool { return createdEvents() > 2 }, 200*time.Millisecond, 10*time.Millisecond,
+		"the Events beyond the burst are dropped")
+}
+
+func TestInjectionEventsWorkload(t *testing.T) {
+	whsvr := newTestWebhookServer()
+	recorder := record.NewFakeRecorder(10)
+	whsvr.Recorder = recorder
+	client := whsvr.K8sClient.(*fake.Clientset)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		GenerateName: "nginx-deployment-6c54bd5869-",
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       "nginx-deployment-6c54bd5869",
+			Controller: lo.ToPtr(true),
+		}},
+	}}
+
+	// Events are recorded on the ReplicaSet without reading the apiserver.
+	events := whsvr.newInjectionEvents(pod, "dummy", false)
+	for i := 0; i < 2; i++ {
+		events.warningf(nil, ReasonSourceNotFound, "Sidecar ConfigMap dummy/missing-%d not found", i)
+	}
+	events.injected(nil, "SidecarTemplate/log-agent", "sidecar log-agent")
+	events.admitted()
+	assert.Empty(t, client.Actions())
+	assert.Equal(t, []string{
+		"Warning SourceNotFound Sidecar ConfigMap dummy/missing-0 not found",
+		"Warning SourceNotFound Sidecar ConfigMap dummy/missing-1 not found",
+		"Normal Injected Injected sidecar log-agent of SidecarTemplate/log-agent into pod dummy/nginx-deployment-6c54bd5869-",
+	}, recordedEvents(recorder))
+
+	// Dry-run requests record nothing.
+	events = whsvr.newInjectionEvents(pod, "dummy", true)
+	events.warningf(&corev1.ConfigMap{}, ReasonSourceNotFound, "Sidecar ConfigMap dummy/missing not found")
+	events.rejectedKeys(&corev1.ConfigMap{}, []string{"FOO.BAR"}, EnvNameStrict)
+	events.injected(&corev1.ConfigMap{}, "ConfigMap dummy/test-config", "env vars")
+	events.admitted()
+	assert.Empty(t, recordedEvents(recorder))
+}
@@ -0,0 +1,162 @@
+package inject
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// failurePolicySuffix is the suffix of the inject annotation overriding the failure policy,
+// e.g. "<prefix>/inject-failure-policy: fail". It is read from the namespace and the pod.
+const failurePolicySuffix = "-failure-policy"
+
+// FailurePolicy decides what happens to a pod whose sidecar ConfigMap or SidecarTemplate is
+// missing or invalid.
+type FailurePolicy string
+
+const (
+	// FailurePolicyIgnore admits the pod without the sidecar and returns a warning.
+	FailurePolicyIgnore FailurePolicy = "ignore"
+	// FailurePolicyFail denies the pod.
+	FailurePolicyFail FailurePolicy = "fail"
+)
+
+// ParseFailurePolicy validates a failure policy name.
+func ParseFailurePolicy(value string) (FailurePolicy, error) {
+	switch policy := FailurePolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case FailurePolicyIgnore, FailurePolicyFail:
+		return policy, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid failure policy %q, expecting one of %s, %s",
+			value,
+			FailurePolicyIgnore,
+			FailurePolicyFail,
+		)
+	}
+}
+
+// failurePolicy returns the failure policy of the namespace annotation, else the default
+// one. The pod annotation can only make it stricter: a pod may ask to fail, not to ignore
+// a namespace that fails. Invalid annotations are returned as warnings. When the Namespace
+// cannot be read the policy is fail.
+func (whsvr *WebhookServer) failurePolicy(
+	ctx context.Context,
+	metadata *metav1.ObjectMeta,
+	namespace string,
+	injectorConfig InjectorConfig,
+) (FailurePolicy, []string) {
+	var warnings []string
+	key := injectorConfig.InjectName + failurePolicySuffix
+	parse := func(object string, objectMeta *metav1.ObjectMeta) (FailurePolicy, bool) {
+		value, err := getAnnotation(objectMeta, key, injectorConfig.InjectPrefix)
+		if err != nil {
+			return "", false
+		}
+		policy, err := ParseFailurePolicy(value)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s annotation %s/%s: %v", object, injectorConfig.InjectPrefix, key, err))
+
+			return "", false
+		}
+
+		return policy, true
+	}
+
+	if policy, ok := parse("pod", metadata); ok && policy == FailurePolicyFail {
+		return policy, warnings
+	}
+	// The namespace may ask to fail: when it cannot be read, the pod is denied rather than
+	// admitted without its sidecar.
+	ns, err := whsvr.K8sClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+	case err != nil:
+		loggerFrom(ctx).Error("Error fetching the Namespace for its failure policy", "error", err)
+		warnings = append(warnings, fmt.Sprintf("failure policy of namespace %s unknown, failing: %v", namespace, err))
+
+		return FailurePolicyFail, warnings
+	default:
+		if policy, ok := parse("namespace "+namespace, &ns.ObjectMeta); ok {
+			return policy, warnings
+		}
+	}
+	if injectorConfig.FailurePolicy != "" {
+		return injectorConfig.FailurePolicy, warnings
+	}
+
+	return FailurePolicyIgnore, warnings
+}
+
+// sidecarSourceError is a ConfigMap or SidecarTemplate of the inject annotation that is
+// missing or cannot be used.
+type sidecarSourceError struct {
+	Reason    metav1.StatusReason
+	Kind      string
+	Namespace string
+	Name      string
+	Message   string
+}
+
+func (e *sidecarSourceError) Error() string {
+	return e.Message
+}
+
+func (e *sidecarSourceError) code() int32 {
+	switch e.Reason {
+	case metav1.StatusReasonNotFound:
+		return http.StatusNotFound
+	case metav1.StatusReasonForbidden:
+		return http.StatusForbidden
+	case metav1.StatusReasonInvalid:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// status describes the error for the denial of a pod, field is the annotation referencing
+// the source.
+func (e *sidecarSourceError) status(field string) *metav1.Status {
+	causeType := metav1.CauseTypeFieldValueInvalid
+	if e.Reason == metav1.StatusReasonNotFound {
+		causeType = metav1.CauseTypeFieldValueNotFound
+	}
+
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: e.Message,
+		Reason:  e.Reason,
+		Code:    e.code(),
+		Details: &metav1.StatusDetails{
+			Name: e.Name,
+			Kind: e.Kind,
+			Causes: []metav1.StatusCause{{
+				Type:    causeType,
+				Message: e.Message,
+				Field:   field,
+			}},
+		},
+	}
+}
+
+// denySidecarSource returns the response denying the pod for the sidecar source error.
+func denySidecarSource(
+	err *sidecarSourceError,
+	injectorConfig InjectorConfig,
+	warnings []string,
+) admissionv1.AdmissionResponse {
+	return admissionv1.AdmissionResponse{
+		Warnings: warnings,
+		Result: err.status(fmt.Sprintf(
+			"metadata.annotations[%s/%s]",
+			injectorConfig.InjectPrefix,
+			injectorConfig.InjectName,
+		)),
+	}
+}
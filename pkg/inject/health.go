@@ -0,0 +1,173 @@
+package inject
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// readinessTimeout bounds the apiserver check of a readiness probe.
+const readinessTimeout = 5 * time.Second
+
+// Names of the readiness checks.
+const (
+	checkAPIServer      = "apiserver"
+	checkConfigMapCache = "configMapCache"
+	checkTemplateCache  = "sidecarTemplateCache"
+	checkCertificate    = "certificate"
+)
+
+// readinessCheck is the result of one readiness check.
+type readinessCheck struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Message string `json:"message,omitempty"`
+}
+
+// readinessReport is the JSON body of /readyz.
+type readinessReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// Health reports that the process is alive. It does not check any dependency, so that a
+// replica losing the apiserver is taken out of the Service rather than restarted.
+func (whsvr *WebhookServer) Health(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Ready reports whether the server can handle admissions: the apiserver is reachable, the
+// ConfigMap and SidecarTemplate caches have synced and the serving certificate is within
+// its validity window.
+// The body is a JSON breakdown of the checks, the status 503 when one of them fails.
+func (whsvr *WebhookServer) Ready(writer http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	report := readinessReport{
+		Ready: true,
+		Checks: []readinessCheck{
+			whsvr.checkAPIServer(ctx),
+			whsvr.checkConfigMapCache(),
+			whsvr.checkTemplateCache(),
+			whsvr.checkCertificate(time.Now()),
+		},
+	}
+	for _, check := range report.Checks {
+		if !check.Ready {
+			report.Ready = false
+			whsvr.logger().Warn("Readiness check failed", "check", check.Name, "message", check.Message)
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(writer).Encode(report); err != nil {
+		whsvr.logger().Error("Could not write readiness report", "error", err)
+	}
+}
+
+// checkAPIServer checks that the apiserver answers the version request. The request is
+// made with ctx, so that it is cancelled when the probe times out.
+func (whsvr *WebhookServer) checkAPIServer(ctx context.Context) readinessCheck {
+	var info version.Info
+	body, err := whsvr.K8sClient.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+	if err == nil {
+		err = json.Unmarshal(body, &info)
+	}
+	if err != nil {
+		return readinessCheck{Name: checkAPIServer, Message: fmt.Sprintf("unreachable: %v", err)}
+	}
+
+	return readinessCheck{Name: checkAPIServer, Ready: true, Message: "reachable, version " + info.GitVersion}
+}
+
+// checkConfigMapCache checks that the ConfigMap informer has completed its initial list.
+func (whsvr *WebhookServer) checkConfigMapCache() readinessCheck {
+	switch {
+	case whsvr.ConfigMaps == nil:
+		return readinessCheck{Name: checkConfigMapCache, Ready: true, Message: "disabled"}
+	case !whsvr.ConfigMaps.HasSynced():
+		return readinessCheck{Name: checkConfigMapCache, Message: "not synced"}
+	default:
+		return readinessCheck{Name: checkConfigMapCache, Ready: true, Message: "synced"}
+	}
+}
+
+// checkTemplateCache checks that the SidecarTemplate informer has completed its initial list.
+func (whsvr *WebhookServer) checkTemplateCache() readinessCheck {
+	switch {
+	case whsvr.SidecarTemplates == nil:
+		return readinessCheck{Name: checkTemplateCache, Ready: true, Message: "disabled"}
+	case !whsvr.SidecarTemplates.HasSynced():
+		return readinessCheck{Name: checkTemplateCache, Message: "not synced"}
+	default:
+		return readinessCheck{Name: checkTemplateCache, Ready: true, Message: "synced"}
+	}
+}
+
+// checkCertificate checks that the serving certificate is valid at now. It is the one served
+// by the reloader when set, else the one of the certificate file.
+func (whsvr *WebhookServer) checkCertificate(now time.Time) readinessCheck {
+	check := readinessCheck{Name: checkCertificate}
+	var cert *x509.Certificate
+	var err error
+	switch {
+	case whsvr.Certificates != nil:
+		if cert = whsvr.Certificates.Leaf(); cert == nil {
+			err = errors.New("no serving certificate loaded")
+		}
+	case whsvr.Params.CertFile != "":
+		cert, err = readCertificate(whsvr.Params.CertFile)
+	default:
+		check.Ready = true
+		check.Message = "no certificate file configured"
+
+		return check
+	}
+
+	switch {
+	case err != nil:
+		check.Message = err.Error()
+	case now.Before(cert.NotBefore):
+		check.Message = fmt.Sprintf("not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		check.Message = fmt.Sprintf("expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	default:
+		check.Ready = true
+		check.Message = fmt.Sprintf("valid until %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	return check
+}
+
+// readCertificate parses the first certificate of the PEM file, the leaf of the chain.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read certificate: %w", err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse certificate %s: %w", path, err)
+		}
+
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("no certificate found in %s", path)
+}
@@ -0,0 +1,135 @@
+package inject
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestAPIServer returns a client of an apiserver answering the requests with handler.
+func newTestAPIServer(t *testing.T, handler http.HandlerFunc) kubernetes.Interface {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func readinessReportOf(t *testing.T, whsvr *WebhookServer) (int, readinessReport) {
+	rec := httptest.NewRecorder()
+	whsvr.Ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var report readinessReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	now := time.Now()
+	var unavailable atomic.Bool
+	client := newTestAPIServer(t, func(writer http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() || r.URL.Path != "/version" {
+			http.Error(writer, "connection refused", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = writer.Write([]byte(`{"gitVersion": "v1.27.1"}`))
+	})
+	whsvr := &WebhookServer{K8sClient: client}
+	whsvr.Params.CertFile, _ = writeTestKeyPair(t, t.TempDir(), 1, now.Add(-time.Hour), now.Add(time.Hour))
+
+	code, report := readinessReportOf(t, whsvr)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Ready)
+	assert.Equal(t, []string{checkAPIServer, checkConfigMapCache, checkTemplateCache, checkCertificate}, []string{
+		report.Checks[0].Name,
+		report.Checks[1].Name,
+		report.Checks[2].Name,
+		report.Checks[3].Name,
+	})
+	assert.Equal(t, "reachable, version v1.27.1", report.Checks[0].Message)
+	assert.Equal(t, "disabled", report.Checks[1].Message)
+	assert.Equal(t, "disabled", report.Checks[2].Message)
+	assert.Contains(t, report.Checks[3].Message, "valid until")
+
+	unavailable.Store(true)
+	whsvr.Params.CertFile, _ = writeTestKeyPair(t, t.TempDir(), 2, now.Add(-2*time.Hour), now.Add(-time.Hour))
+
+	code, report = readinessReportOf(t, whsvr)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Ready)
+	assert.False(t, report.Checks[0].Ready)
+	assert.Contains(t, report.Checks[0].Message, "unreachable: ")
+	assert.True(t, report.Checks[1].Ready)
+	assert.True(t, report.Checks[2].Ready)
+	assert.False(t, report.Checks[3].Ready)
+	assert.Contains(t, report.Checks[3].Message, "expired at")
+}
+
+func TestAPIServerCheckTimeout(t *testing.T) {
+	var cancelled atomic.Bool
+	client := newTestAPIServer(t, func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled.Store(true)
+	})
+	whsvr := &WebhookServer{K8sClient: client}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	check := whsvr.checkAPIServer(ctx)
+	assert.False(t, check.Ready)
+	assert.Contains(t, check.Message, "context deadline exceeded")
+	assert.Eventually(t, cancelled.Load, time.Second, 10*time.Millisecond, "the hung request is cancelled")
+}
+
+func TestCertificateCheck(t *testing.T) {
+	now := time.Now()
+	whsvr := &WebhookServer{}
+
+	whsvr.Params.CertFile, _ = writeTestKeyPair(t, t.TempDir(), 1, now.Add(time.Hour), now.Add(2*time.Hour))
+	check := whsvr.checkCertificate(now)
+	assert.False(t, check.Ready)
+	assert.Contains(t, check.Message, "not valid before")
+
+	whsvr.Params.CertFile = filepath.Join(t.TempDir(), "missing.pem")
+	check = whsvr.checkCertificate(now)
+	assert.False(t, check.Ready)
+	assert.Contains(t, check.Message, "could not read certificate")
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	assert.NoError(t, os.WriteFile(empty, []byte("not a certificate"), 0o600))
+	whsvr.Params.CertFile = empty
+	check = whsvr.checkCertificate(now)
+	assert.False(t, check.Ready)
+	assert.Equal(t, "no certificate found in "+empty, check.Message)
+}
+
+func TestHealth(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "version", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	whsvr := &WebhookServer{K8sClient: client}
+
+	rec := httptest.NewRecorder()
+	whsvr.Health(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "liveness does not depend on the apiserver")
+}
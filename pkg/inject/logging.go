@@ -0,0 +1,90 @@
+package inject
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// Log formats of NewLogger.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// NewLogger creates a logger writing lines of the given format, text or json, at level and
+// above.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expecting one of %s, %s", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// ParseLogLevel validates a log level name: debug, info, warn or error.
+func ParseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return level, fmt.Errorf("invalid log level %q, expecting one of debug, info, warn, error", value)
+	}
+
+	return level, nil
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying the logger of the admission.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of the admission, else the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// logger returns the server logger, else the default logger.
+func (whsvr *WebhookServer) logger() *slog.Logger {
+	if whsvr.Logger != nil {
+		return whsvr.Logger
+	}
+
+	return slog.Default()
+}
+
+// redactedUserInfo logs the requesting user. The values of the extras may hold tokens or
+// other credentials of the authenticator, only their keys are logged.
+type redactedUserInfo authenticationv1.UserInfo
+
+// LogValue implements slog.LogValuer.
+func (u redactedUserInfo) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("username", u.Username),
+		slog.String("uid", u.UID),
+		slog.Any("groups", u.Groups),
+	}
+	if len(u.Extra) > 0 {
+		keys := make([]string, 0, len(u.Extra))
+		for key := range u.Extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attrs = append(attrs, slog.Any("extraKeys", keys))
+	}
+
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,120 @@
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// serveLogged sends the admission request of the pod to a server logging at level, and
+// returns the decoded log lines.
+func serveLogged(t *testing.T, podPath string, level slog.Level) []map[string]interface{} {
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, LogFormatJSON, level)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	whsvr := newTestWebhookServer()
+	whsvr.Params = WebhookServerParameters{
+		InjectPrefix:        "injector.server-lab.info",
+		InjectName:          "inject",
+		InjectConfigMapName: "config",
+		InjectStatusName:    "status",
+		InjectSecretName:    "secret",
+		SidecarDataKey:      "sidecars.yaml",
+	}
+	whsvr.Logger = logger
+
+	req, err := newTestAdmissionRequest(podPath)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(req))
+	httpReq.Header.Set("Content-Type", "application/json")
+	whsvr.Serve(httptest.NewRecorder(), httpReq)
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if assert.NoError(t, json.Unmarshal([]byte(line), &entry), line) {
+			lines = append(lines, entry)
+		}
+	}
+
+	return lines
+}
+
+func TestAdmissionLogs(t *testing.T) {
+	lines := serveLogged(t, "./testdata/mixed-annotated-pod.json", slog.LevelDebug)
+	if !assert.NotEmpty(t, lines) {
+		return
+	}
+
+	var messages []string
+	var patch string
+	for _, line := range lines {
+		assert.Equal(t, "0df28fbd-5f5f-11e8-bc74-36e6bb280816", line["uid"], line["msg"])
+		assert.Equal(t, "dummy", line["namespace"], line["msg"])
+		messages = append(messages, line["msg"].(string))
+		if line["msg"] == "Generated patch" {
+			patch, _ = line["patch"].(string)
+		}
+	}
+	assert.Contains(t, messages, "Admission request")
+	assert.Contains(t, messages, "Pod mutated")
+	assert.Contains(t, patch, `"op":"add"`)
+	assert.Equal(t, "Writing admission response", messages[len(messages)-1])
+
+	for _, line := range serveLogged(t, "./testdata/mixed-annotated-pod.json", slog.LevelInfo) {
+		assert.NotEqual(t, "Generated patch", line["msg"])
+		assert.NotEqual(t, "DEBUG", line["level"])
+	}
+}
+
+func TestRedactedUserInfo(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, LogFormatText, slog.LevelInfo)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logger.Info("Admission request", "user", redactedUserInfo(authenticationv1.UserInfo{
+		Username: "jane",
+		UID:      "1234",
+		Groups:   []string{"system:authenticated"},
+		Extra: map[string]authenticationv1.ExtraValue{
+			"authentication.kubernetes.io/credential-id": {"JTI=secret-token-id"},
+			"scopes.example.com":                         {"admin"},
+		},
+	}))
+
+	line := out.String()
+	assert.Contains(t, line, "user.username=jane")
+	assert.Contains(t, line, "user.uid=1234")
+	assert.Contains(t, line, "user.extraKeys=\"[authentication.kubernetes.io/credential-id scopes.example.com]\"")
+	assert.NotContains(t, line, "secret-token-id")
+	assert.NotContains(t, line, "admin")
+}
+
+func TestParseLogSettings(t *testing.T) {
+	level, err := ParseLogLevel("debug")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+	level, err = ParseLogLevel(" WARN ")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+	_, err = ParseLogLevel("verbose")
+	assert.EqualError(t, err, `invalid log level "verbose", expecting one of debug, info, warn, error`)
+
+	_, err = NewLogger(&bytes.Buffer{}, "JSON", slog.LevelInfo)
+	assert.NoError(t, err)
+	_, err = NewLogger(&bytes.Buffer{}, "logfmt", slog.LevelInfo)
+	assert.EqualError(t, err, `invalid log format "logfmt", expecting one of text, json`)
+}
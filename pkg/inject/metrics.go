@@ -0,0 +1,172 @@
+package inject
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admissionv1 "k8s.io/api/admission/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const metricsNamespace = "k8_injector"
+
+// Admission outcomes of the admissions metrics.
+const (
+	outcomeMutated = "mutated"
+	outcomeAllowed = "allowed"
+	outcomeDenied  = "denied"
+	outcomeInvalid = "invalid"
+)
+
+// Metrics are the Prometheus metrics of the webhook. A nil *Metrics records nothing.
+type Metrics struct {
+	admissions         *prometheus.CounterVec
+	admissionDuration  *prometheus.HistogramVec
+	sidecarInjections  *prometheus.CounterVec
+	configMapLookups   *prometheus.HistogramVec
+	configMapErrors    *prometheus.CounterVec
+	sidecarParseErrors *prometheus.CounterVec
+	patchSize          prometheus.Histogram
+	certificateReloads *prometheus.CounterVec
+	certificateExpiry  prometheus.Gauge
+}
+
+// NewMetrics creates the webhook metrics and registers them with registerer.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		admissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "admissions_total",
+			Help:      "Admission requests by operation and outcome (mutated, allowed, denied, invalid).",
+		}, []string{"operation", "outcome"}),
+		admissionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "admission_duration_seconds",
+			Help:      "Time to handle an admission request by operation and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "outcome"}),
+		sidecarInjections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sidecar_injections_total",
+			Help:      "Sidecars injected into admitted pods by source and sidecar name.",
+		}, []string{"source", "sidecar"}),
+		configMapLookups: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_lookup_duration_seconds",
+			Help:      "Time to look up a sidecar or env ConfigMap from the cache or the apiserver.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"backend"}),
+		configMapErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "configmap_lookup_errors_total",
+			Help:      "Failed ConfigMap lookups by backend and reason (not_found, error).",
+		}, []string{"backend", "reason"}),
+		sidecarParseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sidecar_parse_failures_total",
+			Help:      "Sidecar ConfigMaps or SidecarTemplates that could not be rendered or decoded, by source.",
+		}, []string{"source"}),
+		patchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "patch_size_bytes",
+			Help:      "Size of the JSON patches returned for mutated pods.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 7),
+		}),
+		certificateReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "certificate_reloads_total",
+			Help:      "Reloads of the serving certificate by result (success, failure).",
+		}, []string{"result"}),
+		certificateExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "Expiry of the serving certificate in seconds since the epoch.",
+		}),
+	}
+	registerer.MustRegister(
+		m.admissions,
+		m.admissionDuration,
+		m.sidecarInjections,
+		m.configMapLookups,
+		m.configMapErrors,
+		m.sidecarParseErrors,
+		m.patchSize,
+		m.certificateReloads,
+		m.certificateExpiry,
+	)
+
+	return m
+}
+
+// admissionOutcome classifies an admission response.
+func admissionOutcome(resp *admissionv1.AdmissionResponse) string {
+	switch {
+	case !resp.Allowed:
+		return outcomeDenied
+	case len(resp.Patch) > 0:
+		return outcomeMutated
+	default:
+		return outcomeAllowed
+	}
+}
+
+// observeAdmission records one handled admission and the size of its patch.
+func (m *Metrics) observeAdmission(operation string, outcome string, start time.Time, patchSize int) {
+	if m == nil {
+		return
+	}
+	if operation == "" {
+		operation = "UNKNOWN"
+	}
+	m.admissions.WithLabelValues(operation, outcome).Inc()
+	m.admissionDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+	if outcome == outcomeMutated {
+		m.patchSize.Observe(float64(patchSize))
+	}
+}
+
+// sidecarsInjected counts the sidecars injected into an admitted pod.
+func (m *Metrics) sidecarsInjected(sidecars []InjectedSidecar) {
+	if m == nil {
+		return
+	}
+	for _, sidecar := range sidecars {
+		m.sidecarInjections.WithLabelValues(sidecar.Source, sidecar.Name).Inc()
+	}
+}
+
+// observeConfigMapLookup records the latency and the error of one ConfigMap lookup.
+func (m *Metrics) observeConfigMapLookup(backend string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.configMapLookups.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	if k8serrors.IsNotFound(err) {
+		m.configMapErrors.WithLabelValues(backend, "not_found").Inc()
+	} else if err != nil {
+		m.configMapErrors.WithLabelValues(backend, "error").Inc()
+	}
+}
+
+// sidecarParseFailed counts a sidecar source that cannot be rendered or decoded.
+func (m *Metrics) sidecarParseFailed(source string) {
+	if m == nil {
+		return
+	}
+	m.sidecarParseErrors.WithLabelValues(source).Inc()
+}
+
+// certificateReloaded records one reload of the serving certificate, cert is nil when the
+// reload failed.
+func (m *Metrics) certificateReloaded(cert *x509.Certificate) {
+	if m == nil {
+		return
+	}
+	if cert == nil {
+		m.certificateReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	m.certificateReloads.WithLabelValues("success").Inc()
+	m.certificateExpiry.Set(float64(cert.NotAfter.Unix()))
+}
@@ -0,0 +1,93 @@
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestMetrics(t *testing.T) {
+	whsvr := newTestWebhookServer()
+	whsvr.Params = WebhookServerParameters{
+		InjectPrefix:        "injector.server-lab.info",
+		InjectName:          "inject",
+		InjectConfigMapName: "config",
+		InjectStatusName:    "status",
+		InjectSecretName:    "secret",
+		SidecarDataKey:      "sidecars.yaml",
+	}
+	registry := prometheus.NewRegistry()
+	whsvr.Metrics = NewMetrics(registry)
+	serve := func(path string) {
+		req, err := newTestAdmissionRequest(path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		httpReq := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(req))
+		httpReq.Header.Set("Content-Type", "application/json")
+		whsvr.Serve(httptest.NewRecorder(), httpReq)
+	}
+
+	serve("./testdata/sidecar-annotated-pod.json")
+	serve("./testdata/mixed-annotated-pod.json")
+	serve("./testdata/broken-template-annotated-pod.json")
+	serve("./testdata/missing-annotations.json")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(whsvr.Metrics.admissions.WithLabelValues("CREATE", outcomeMutated)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(whsvr.Metrics.admissions.WithLabelValues("CREATE", outcomeDenied)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(whsvr.Metrics.admissions.WithLabelValues("CREATE", outcomeAllowed)))
+	assert.Equal(t, 3, testutil.CollectAndCount(whsvr.Metrics.admissionDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(whsvr.Metrics.patchSize))
+	assert.Equal(t, 2.0, testutil.ToFloat64(
+		whsvr.Metrics.sidecarInjections.WithLabelValues("dummy/sidecar-config", "haystack-agent"),
+	))
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		whsvr.Metrics.sidecarParseErrors.WithLabelValues("dummy/broken-template-sidecar"),
+	))
+	assert.Equal(t, 0, testutil.CollectAndCount(whsvr.Metrics.configMapErrors))
+
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, family := range families {
+		if family.GetName() == "k8_injector_configmap_lookup_duration_seconds" {
+			// sidecar-config twice, test-config and broken-template-sidecar.
+			assert.Equal(t, "apiserver", family.GetMetric()[0].GetLabel()[0].GetValue())
+			assert.Equal(t, uint64(4), family.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.sidecarParseFailed("ignored")
+}
+
+func TestServeInvalidReview(t *testing.T) {
+	whsvr := newTestWebhookServer()
+	whsvr.Metrics = NewMetrics(prometheus.NewRegistry())
+
+	for _, body := range []string{
+		`{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+		`{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": `,
+	} {
+		httpReq := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		whsvr.Serve(rec, httpReq)
+
+		var review admissionv1.AdmissionReview
+		if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &review)) && assert.NotNil(t, review.Response) {
+			assert.False(t, review.Response.Allowed)
+			assert.NotEmpty(t, review.Response.Result.Message)
+		}
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(whsvr.Metrics.admissions.WithLabelValues("UNKNOWN", outcomeInvalid)))
+}
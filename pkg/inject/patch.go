@@ -17,7 +17,8 @@ type rfc6902PatchOperation struct {
 
 // RFC6902 JSON patch operations.
 const (
-	patchOperationAdd = "add"
+	patchOperationAdd     = "add"
+	patchOperationReplace = "replace"
 )
 
 // create mutation patch for resources.
@@ -25,25 +26,44 @@ func createPatch(
 	pod *corev1.Pod,
 	sidecarConfig *PatchConfig,
 ) ([]byte, error) {
+	// Replaced containers come first, the env and volume mounts below are computed against
+	// the replacements.
 	var patch []rfc6902PatchOperation
-	if sidecarConfig.Envs != nil {
-		for idx, c := range pod.Spec.Containers {
-			finalEnvs := make([]corev1.EnvVar, 0)
-			if c.Env != nil {
-				finalEnvs = append(finalEnvs, c.Env...)
-			}
-			finalEnvs = append(finalEnvs, sidecarConfig.Envs...)
-			sort.SliceStable(finalEnvs, func(i, j int) bool {
-				return finalEnvs[i].Name < finalEnvs[j].Name
-			})
-			p := rfc6902PatchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/env", idx),
-				Value: finalEnvs,
-			}
-			patch = append(patch, p)
-		}
-	}
+	patch = append(
+		patch,
+		replaceItems(
+			sidecarConfig.Replacements.InitContainers,
+			"/spec/initContainers",
+		)...,
+	)
+	patch = append(
+		patch,
+		replaceItems(
+			sidecarConfig.Replacements.Containers,
+			"/spec/containers",
+		)...,
+	)
+	patch = append(
+		patch,
+		replaceItems(
+			sidecarConfig.Replacements.Volumes,
+			"/spec/volumes",
+		)...,
+	)
+	patch = append(
+		patch,
+		addEnvs(
+			sidecarConfig.ContainerEnvs,
+			"/spec/containers",
+		)...,
+	)
+	patch = append(
+		patch,
+		addEnvs(
+			sidecarConfig.InitContainerEnvs,
+			"/spec/initContainers",
+		)...,
+	)
 	if sidecarConfig.InitContainers != nil {
 		patch = append(
 			patch,
@@ -73,6 +93,16 @@ func createPatch(
 			)...,
 		)
 	}
+	if sidecarConfig.ImagePullSecrets != nil {
+		patch = append(
+			patch,
+			addImagePullSecrets(
+				pod.Spec.ImagePullSecrets,
+				sidecarConfig.ImagePullSecrets,
+				"/spec/imagePullSecrets",
+			)...,
+		)
+	}
 	if sidecarConfig.Annotations != nil {
 		patch = append(
 			patch,
@@ -91,11 +121,20 @@ func createPatch(
 			)...,
 		)
 	}
+	for idx, container := range pod.Spec.Containers {
+		patch = append(
+			patch,
+			replaceItems(
+				sidecarConfig.Replacements.VolumeMounts[container.Name],
+				fmt.Sprintf("/spec/containers/%d/volumeMounts", idx),
+			)...,
+		)
+	}
 	if sidecarConfig.ContainerVolumeMounts != nil {
 		patch = append(
 			patch,
 			addVolumeMounts(
-				pod.Spec.Containers,
+				replacedContainers(pod.Spec.Containers, sidecarConfig.Replacements.Containers),
 				sidecarConfig.ContainerVolumeMounts,
 				"/spec/containers",
 			)...,
@@ -105,6 +144,38 @@ func createPatch(
 	return json.Marshal(patch)
 }
 
+// addEnvs creates a patch setting the merged env and envFrom of the containers.
+func addEnvs(
+	envs map[int]ContainerEnv,
+	basePath string,
+) []rfc6902PatchOperation {
+	indexes := make([]int, 0, len(envs))
+	for idx := range envs {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	var patch []rfc6902PatchOperation
+	for _, idx := range indexes {
+		if envs[idx].Env != nil {
+			patch = append(patch, rfc6902PatchOperation{
+				Op:    patchOperationAdd,
+				Path:  fmt.Sprintf("%s/%d/env", basePath, idx),
+				Value: envs[idx].Env,
+			})
+		}
+		if envs[idx].EnvFrom != nil {
+			patch = append(patch, rfc6902PatchOperation{
+				Op:    patchOperationAdd,
+				Path:  fmt.Sprintf("%s/%d/envFrom", basePath, idx),
+				Value: envs[idx].EnvFrom,
+			})
+		}
+	}
+
+	return patch
+}
+
 // addContainer create a patch for adding containers.
 func addContainer(
 	target, added []corev1.Container,
@@ -134,6 +205,47 @@ func addContainer(
 	return patch
 }
 
+// replaceItems creates a patch replacing the list items at the given indexes.
+func replaceItems[T any](
+	replacements map[int]T,
+	basePath string,
+) []rfc6902PatchOperation {
+	indexes := make([]int, 0, len(replacements))
+	for idx := range replacements {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	patch := make([]rfc6902PatchOperation, 0, len(indexes))
+	for _, idx := range indexes {
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    patchOperationReplace,
+			Path:  fmt.Sprintf("%s/%d", basePath, idx),
+			Value: replacements[idx],
+		})
+	}
+
+	return patch
+}
+
+// replacedContainers returns the containers as they are after the replacements.
+func replacedContainers(
+	target []corev1.Container,
+	replacements map[int]corev1.Container,
+) []corev1.Container {
+	if len(replacements) == 0 {
+		return target
+	}
+
+	containers := make([]corev1.Container, len(target))
+	copy(containers, target)
+	for idx, container := range replacements {
+		containers[idx] = container
+	}
+
+	return containers
+}
+
 // addVolumeMounts creates a patch for adding volume mounts.
 func addVolumeMounts(
 	target []corev1.Container,
@@ -203,10 +315,65 @@ func addVolume(
 	return patch
 }
 
+// newImagePullSecrets returns the added image pull secrets missing from target, without
+// duplicates.
+func newImagePullSecrets(target, added []corev1.LocalObjectReference) []corev1.LocalObjectReference {
+	seen := map[string]bool{}
+	for _, secret := range target {
+		seen[secret.Name] = true
+	}
+
+	var secrets []corev1.LocalObjectReference
+	for _, secret := range added {
+		if secret.Name == "" || seen[secret.Name] {
+			continue
+		}
+		seen[secret.Name] = true
+		secrets = append(secrets, secret)
+	}
+
+	return secrets
+}
+
+// addImagePullSecrets creates a patch for adding image pull secrets.
+func addImagePullSecrets(
+	target, added []corev1.LocalObjectReference,
+	basePath string,
+) []rfc6902PatchOperation {
+	first := len(target) == 0
+	var (
+		value interface{}
+	)
+	patch := make([]rfc6902PatchOperation, 0)
+	for _, add := range newImagePullSecrets(target, added) {
+		value = add
+		path := basePath
+
+		if first {
+			first = false
+			value = []corev1.LocalObjectReference{add}
+		} else {
+			path += "/-"
+		}
+
+		patch = append(patch, rfc6902PatchOperation{
+			Op:    patchOperationAdd,
+			Path:  path,
+			Value: value,
+		})
+	}
+
+	return patch
+}
+
 // updateAnnotation creates a patch for adding/updating annotations.
 func updateAnnotation(target, added map[string]string) []rfc6902PatchOperation {
 	var patch []rfc6902PatchOperation
 
+	if target == nil {
+		target = map[string]string{}
+	}
+
 	for key, value := range added {
 		target[key] = value
 	}
@@ -220,10 +387,14 @@ func updateAnnotation(target, added map[string]string) []rfc6902PatchOperation {
 	return patch
 }
 
-// updateAnnotation creates a patch for adding/updating annotations.
+// updateLabels creates a patch for adding/updating labels.
 func updateLabels(target, added map[string]string) []rfc6902PatchOperation {
 	var patch []rfc6902PatchOperation
 
+	if target == nil {
+		target = map[string]string{}
+	}
+
 	for key, value := range added {
 		target[key] = value
 	}
@@ -0,0 +1,280 @@
+package inject
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// templatedAnnotationName is the suffix of the ConfigMap annotation opting its sidecars.yaml
+// into Go template rendering, e.g. "injector.server-lab.info/templated: \"true\"". Other
+// ConfigMaps are decoded as is, so a literal "{{" keeps working.
+const templatedAnnotationName = "templated"
+
+// Bounds of the rendering of a sidecars.yaml template, so that a ConfigMap cannot stall or
+// balloon the admissions.
+const (
+	renderTimeout = time.Second
+	// maxRenderedSize is the size limit of a ConfigMap.
+	maxRenderedSize = 1 << 20
+	// maxTemplateSequence bounds the lists of until and untilStep.
+	maxTemplateSequence = 10000
+	// maxTemplateItems bounds the items of all the lists generated by one execution, and
+	// with them the iterations of nested ranges.
+	maxTemplateItems = 100000
+)
+
+// errRenderAborted stops the execution of a template that exceeded renderTimeout.
+var errRenderAborted = errors.New("rendering aborted")
+
+// unsafeTemplateFuncs are the sprig functions reading the webhook environment or network,
+// or too costly to run on the admission path.
+var unsafeTemplateFuncs = []string{
+	"env", "expandenv", "getHostByName",
+	"genPrivateKey", "genCA", "genCAWithKey", "genSelfSignedCert", "genSelfSignedCertWithKey",
+	"genSignedCert", "genSignedCertWithKey", "buildCustomCert", "bcrypt", "htpasswd", "derivePassword",
+	"seq",
+}
+
+// renderBudget bounds the work of one execution of a template. The lists and strings
+// generated by the template functions are charged to it, and the functions fail once it is
+// spent or ctx is done, which stops the execution.
+type renderBudget struct {
+	ctx   context.Context
+	items int
+	bytes int
+}
+
+func newRenderBudget(ctx context.Context) *renderBudget {
+	return &renderBudget{ctx: ctx, items: maxTemplateItems, bytes: maxRenderedSize}
+}
+
+// charge spends items list items and size bytes of the budget.
+func (b *renderBudget) charge(items int, size int) error {
+	if b.ctx.Err() != nil {
+		return errRenderAborted
+	}
+	b.items -= items
+	b.bytes -= size
+	switch {
+	case b.items < 0:
+		return fmt.Errorf("generated lists exceed %d items", maxTemplateItems)
+	case b.bytes < 0:
+		return fmt.Errorf("generated strings exceed %d bytes", maxRenderedSize)
+	}
+
+	return nil
+}
+
+// SidecarTemplateData is the pod context available to sidecars.yaml templates, e.g.
+// {{ .ObjectMeta.Labels.app }} or {{ index .ObjectMeta.Annotations "example.com/key" }}.
+type SidecarTemplateData struct {
+	ObjectMeta     metav1.ObjectMeta
+	Namespace      string
+	ServiceAccount string
+	Containers     []corev1.Container
+}
+
+func newSidecarTemplateData(pod *corev1.Pod, namespace string) SidecarTemplateData {
+	return SidecarTemplateData{
+		ObjectMeta:     pod.ObjectMeta,
+		Namespace:      namespace,
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		Containers:     pod.Spec.Containers,
+	}
+}
+
+// sidecarRenderError is returned when a sidecars.yaml template cannot be parsed or executed.
+type sidecarRenderError struct {
+	err error
+}
+
+func (e *sidecarRenderError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sidecarRenderError) Unwrap() error {
+	return e.err
+}
+
+// sidecarsTemplated reports whether the sidecars.yaml of the ConfigMap is a template.
+func sidecarsTemplated(cm *corev1.ConfigMap, prefix string) bool {
+	value, err := getAnnotation(&cm.ObjectMeta, templatedAnnotationName, prefix)
+	if err != nil {
+		return false
+	}
+	templated, _ := strconv.ParseBool(value)
+
+	return templated
+}
+
+// templateFuncs returns the sprig functions without the unsafe ones. The functions
+// generating lists or strings of a given size are bounded and charged to budget.
+func templateFuncs(budget *renderBudget) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	for _, name := range unsafeTemplateFuncs {
+		delete(funcs, name)
+	}
+
+	until := funcs["until"].(func(int) []int)
+	untilStep := funcs["untilStep"].(func(int, int, int) []int)
+	funcs["repeat"] = func(count int, str string) (string, error) {
+		if count < 0 || count*len(str) > maxRenderedSize {
+			return "", fmt.Errorf("repeat of %d times exceeds %d bytes", count, maxRenderedSize)
+		}
+		if err := budget.charge(0, count*len(str)); err != nil {
+			return "", err
+		}
+
+		return strings.Repeat(str, count), nil
+	}
+	funcs["until"] = func(count int) ([]int, error) {
+		if count > maxTemplateSequence || count < -maxTemplateSequence {
+			return nil, fmt.Errorf("until %d exceeds %d items", count, maxTemplateSequence)
+		}
+		items := until(count)
+
+		return items, budget.charge(len(items), 0)
+	}
+	funcs["untilStep"] = func(start, stop, step int) ([]int, error) {
+		if step != 0 && (stop-start)/step > maxTemplateSequence {
+			return nil, fmt.Errorf("untilStep %d %d %d exceeds %d items", start, stop, step, maxTemplateSequence)
+		}
+		items := untilStep(start, stop, step)
+
+		return items, budget.charge(len(items), 0)
+	}
+	for _, name := range []string{"randAlphaNum", "randAlpha", "randAscii", "randNumeric"} {
+		random := funcs[name].(func(int) string)
+		funcs[name] = func(count int) (string, error) {
+			if err := budget.charge(0, count); err != nil {
+				return "", err
+			}
+
+			return random(count), nil
+		}
+	}
+	randBytes := funcs["randBytes"].(func(int) (string, error))
+	funcs["randBytes"] = func(count int) (string, error) {
+		if err := budget.charge(0, count); err != nil {
+			return "", err
+		}
+
+		return randBytes(count)
+	}
+	for _, name := range []string{"indent", "nindent"} {
+		indent := funcs[name].(func(int, string) string)
+		funcs[name] = func(spaces int, str string) (string, error) {
+			if err := budget.charge(0, spaces*(strings.Count(str, "\n")+1)); err != nil {
+				return "", err
+			}
+
+			return indent(spaces, str), nil
+		}
+	}
+
+	return funcs
+}
+
+// parseSidecars parses a sidecars.yaml document: the template when templated, else the
+// decoded sidecars.
+func parseSidecars(name string, data string, templated bool) (*template.Template, []Sidecar, error) {
+	if templated {
+		tmpl, err := parseSidecarsTemplate(name, data)
+		return tmpl, nil, err
+	}
+	sidecars, err := decodeSidecars([]byte(data))
+
+	return nil, sidecars, err
+}
+
+// decodeSidecars decodes a sidecars.yaml document.
+func decodeSidecars(data []byte) ([]Sidecar, error) {
+	var sidecars []Sidecar
+	if err := yaml.Unmarshal(data, &sidecars); err != nil {
+		return nil, err
+	}
+
+	return sidecars, nil
+}
+
+// parseSidecarsTemplate parses a sidecars.yaml document as a Go template. The template is
+// named after its source so that errors read "template: namespace/name:line: ...".
+func parseSidecarsTemplate(name string, data string) (*template.Template, error) {
+	// The functions are bound to the budget of each execution by renderSidecars, the ones
+	// bound here have none.
+	tmpl, err := template.New(name).
+		Option("missingkey=zero").
+		Funcs(templateFuncs(&renderBudget{ctx: context.Background()})).
+		Parse(data)
+	if err != nil {
+		return nil, &sidecarRenderError{err: err}
+	}
+
+	return tmpl, nil
+}
+
+// renderBuffer collects the output of a template. Writes past maxRenderedSize or after an
+// abort fail, which stops the execution.
+type renderBuffer struct {
+	buffer  bytes.Buffer
+	aborted atomic.Bool
+}
+
+func (b *renderBuffer) Write(p []byte) (int, error) {
+	if b.aborted.Load() {
+		return 0, errRenderAborted
+	}
+	if b.buffer.Len()+len(p) > maxRenderedSize {
+		return 0, fmt.Errorf("rendered output exceeds %d bytes", maxRenderedSize)
+	}
+
+	return b.buffer.Write(p)
+}
+
+// renderSidecars executes the sidecars.yaml template for the pod and decodes the result.
+// The execution is bounded by a renderBudget. One still running after renderTimeout is
+// abandoned, it stops at its next function call or write.
+func renderSidecars(tmpl *template.Template, data SidecarTemplateData) ([]Sidecar, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+	execution, err := tmpl.Clone()
+	if err != nil {
+		return nil, &sidecarRenderError{err: err}
+	}
+	execution.Funcs(templateFuncs(newRenderBudget(ctx)))
+
+	rendered := &renderBuffer{}
+	result := make(chan error, 1)
+	go func() {
+		result <- execution.Execute(rendered, data)
+	}()
+
+	select {
+	case err = <-result:
+		if err != nil {
+			return nil, &sidecarRenderError{err: err}
+		}
+	case <-ctx.Done():
+		rendered.aborted.Store(true)
+		return nil, &sidecarRenderError{err: fmt.Errorf("template: %s: rendering exceeded %s", tmpl.Name(), renderTimeout)}
+	}
+
+	sidecars, err := decodeSidecars(rendered.buffer.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("decoding rendered %s: %w", tmpl.Name(), err)
+	}
+
+	return sidecars, nil
+}
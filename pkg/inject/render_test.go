@@ -0,0 +1,187 @@
+package inject
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUntemplatedSidecars(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "dummy", Name: "literal-sidecar"},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: log-agent
+  containers:
+    - name: log-agent
+      image: fluent/fluent-bit:2.1
+      args: ["--format", "{{ .Message }}"]
+`,
+		},
+	}
+	whsvr := newTestWebhookServer()
+	sidecars, err := whsvr.configMapSidecars(cm, testInjectorConfig(), SidecarTemplateData{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"--format", "{{ .Message }}"}, sidecars[0].Containers[0].Args)
+	}
+
+	cm.Annotations = map[string]string{"injector.server-lab.info/templated": "false"}
+	_, err = whsvr.configMapSidecars(cm, testInjectorConfig(), SidecarTemplateData{})
+	assert.NoError(t, err)
+}
+
+func TestRenderSidecarsBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{
+			name:     "repeat",
+			template: `- name: {{ repeat 10000000 "a" }}`,
+			err:      "repeat of 10000000 times exceeds 1048576 bytes",
+		},
+		{
+			name:     "until",
+			template: `{{ range until 100000000 }}{{ end }}`,
+			err:      "until 100000000 exceeds 10000 items",
+		},
+		{
+			name:     "untilStep",
+			template: `{{ range untilStep 0 100000000 1 }}{{ end }}`,
+			err:      "untilStep 0 100000000 1 exceeds 10000 items",
+		},
+		{
+			name:     "output size",
+			template: `{{ range until 2000 }}` + strings.Repeat("a", 1000) + `{{ end }}`,
+			err:      "rendered output exceeds 1048576 bytes",
+		},
+		{
+			name:     "nested ranges",
+			template: `{{- range until 10000 }}{{- range until 10000 }}{{- range until 10 }}{{- end }}{{- end }}{{- end }}`,
+			err:      "generated lists exceed 100000 items",
+		},
+		{
+			name:     "repeats",
+			template: `{{ range until 2000 }}{{ $a := repeat 1000 "a" }}{{ end }}`,
+			err:      "generated strings exceed 1048576 bytes",
+		},
+		{
+			name:     "indent",
+			template: `{{ range until 2000 }}{{ $a := indent 1000 "a" }}{{ end }}`,
+			err:      "generated strings exceed 1048576 bytes",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := parseSidecarsTemplate("dummy/bounded", test.template)
+			if !assert.NoError(t, err) {
+				return
+			}
+			start := time.Now()
+			_, err = renderSidecars(tmpl, SidecarTemplateData{})
+			assert.Less(t, time.Since(start), renderTimeout, "the execution stops before the timeout")
+			var renderErr *sidecarRenderError
+			assert.ErrorAs(t, err, &renderErr)
+			assert.ErrorContains(t, err, test.err)
+		})
+	}
+
+	tmpl, err := parseSidecarsTemplate("dummy/bounded", `{{ range until 3 }}- name: s{{ . }}{{ "\n" }}{{ end }}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sidecars, err := renderSidecars(tmpl, SidecarTemplateData{})
+	if assert.NoError(t, err) {
+		assert.Len(t, sidecars, 3)
+	}
+}
+
+func TestUnsafeTemplateFuncs(t *testing.T) {
+	for _, name := range unsafeTemplateFuncs {
+		_, err := parseSidecarsTemplate("dummy/unsafe", "{{ "+name+" }}")
+		assert.ErrorContains(t, err, `function "`+name+`" not defined`)
+	}
+}
+
+func TestRenderBudgetCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	funcs := templateFuncs(newRenderBudget(ctx))
+	until := funcs["until"].(func(int) ([]int, error))
+	_, err := until(3)
+	assert.NoError(t, err)
+
+	// Once the render times out, the next function call stops the execution.
+	cancel()
+	_, err = until(3)
+	assert.ErrorIs(t, err, errRenderAborted)
+}
+
+func TestRenderBufferAbort(t *testing.T) {
+	buffer := &renderBuffer{}
+	_, err := buffer.Write([]byte("- name: log-agent"))
+	assert.NoError(t, err)
+	buffer.aborted.Store(true)
+	_, err = buffer.Write([]byte(strings.Repeat("a", 10)))
+	assert.ErrorIs(t, err, errRenderAborted)
+}
+
+func TestDecodeSidecarsFieldNames(t *testing.T) {
+	expected := []Sidecar{{
+		Name: "haystack-agent",
+		Containers: []corev1.Container{{
+			Name:            "haystack-agent",
+			Image:           "expediadotcom/haystack-agent",
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			VolumeMounts:    []corev1.VolumeMount{{Name: "agent-conf", MountPath: "/app/haystack"}},
+		}},
+		Volumes: []corev1.Volume{{
+			Name: "agent-conf",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "haystack-agent-conf-configmap"},
+				},
+			},
+		}},
+	}}
+
+	// The Kubernetes field names, which the YAML tags of earlier releases dropped.
+	sidecars, err := decodeSidecars([]byte(`- name: haystack-agent
+  containers:
+    - name: haystack-agent
+      image: expediadotcom/haystack-agent
+      imagePullPolicy: IfNotPresent
+      volumeMounts:
+        - name: agent-conf
+          mountPath: /app/haystack
+  volumes:
+    - name: agent-conf
+      configMap:
+        name: haystack-agent-conf-configmap
+`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, sidecars)
+	}
+
+	// The lowercased field names read by earlier releases.
+	sidecars, err = decodeSidecars([]byte(`- name: haystack-agent
+  containers:
+    - name: haystack-agent
+      image: expediadotcom/haystack-agent
+      imagepullpolicy: IfNotPresent
+      volumemounts:
+        - name: agent-conf
+          mountpath: /app/haystack
+  volumes:
+    - name: agent-conf
+      configMap:
+        name: haystack-agent-conf-configmap
+`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, sidecars)
+	}
+}
@@ -0,0 +1,84 @@
+package inject
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// secretEnvMode returns the env mode of the secret annotation. Secret values are never
+// copied into the pod spec, so the value mode falls back to keyRef, with a warning when
+// the pod asked for it explicitly.
+func secretEnvMode(
+	metadata *metav1.ObjectMeta,
+	injectorConfig InjectorConfig,
+	mode EnvMode,
+) (EnvMode, []string) {
+	if mode != EnvModeValue {
+		return mode, nil
+	}
+
+	var warnings []string
+	modeAnnotation := injectorConfig.InjectSecretName + envModeSuffix
+	if _, err := getAnnotation(metadata, modeAnnotation, injectorConfig.InjectPrefix); err == nil {
+		warnings = append(warnings, fmt.Sprintf(
+			"env mode %s is not supported for Secrets, using %s",
+			EnvModeValue,
+			EnvModeKeyRef,
+		))
+	}
+
+	return EnvModeKeyRef, warnings
+}
+
+// generateSecretEnvs references the Secret keys with secretKeyRef env vars, or the whole
+// Secret with one envFrom entry. Only the keys of the Secret are read, never its values.
+// Keys which are not valid env var names are returned as invalid. For envFrom the Secret
+// is only fetched as metadata, its keys are checked by the kubelet instead.
+func generateSecretEnvs(
+	secret *corev1.Secret,
+	mode EnvMode,
+	validation EnvNameValidation,
+) ([]corev1.EnvVar, []corev1.EnvFromSource, []string) {
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var envs []corev1.EnvVar
+	var invalid []string
+	for _, key := range keys {
+		if !validation.valid(key) {
+			invalid = append(invalid, key)
+			continue
+		}
+		if mode == EnvModeEnvFrom {
+			continue
+		}
+
+		envs = append(envs, corev1.EnvVar{
+			Name: key,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+					Key:                  key,
+				},
+			},
+		})
+	}
+
+	if mode == EnvModeEnvFrom {
+		return nil, []corev1.EnvFromSource{
+			{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+				},
+			},
+		}, invalid
+	}
+
+	return envs, nil, invalid
+}
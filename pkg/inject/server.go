@@ -3,15 +3,22 @@ package inject
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
 	"github.com/samber/lo"
-	"gopkg.in/yaml.v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	admissionv1 "k8s.io/api/admission/v1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	v1 "k8s.io/api/apps/v1"
@@ -20,7 +27,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -52,17 +62,51 @@ type WebhookServer struct {
 	Server    *http.Server
 	Params    WebhookServerParameters
 	K8sClient kubernetes.Interface
+	// DynamicClient resolves SidecarTemplate resources. When nil only ConfigMaps are used.
+	DynamicClient dynamic.Interface
+	// MetadataClient looks up Secrets whose data is not needed, e.g. image pull secrets.
+	// When nil the Secrets are fetched in full from K8sClient.
+	MetadataClient metadata.Interface
+	// ConfigMaps serves ConfigMaps from an informer. When nil ConfigMaps are fetched from
+	// the apiserver on every admission.
+	ConfigMaps *ConfigMapCache
+	// SidecarTemplates serves SidecarTemplates from an informer. When nil they are fetched
+	// through DynamicClient on every admission.
+	SidecarTemplates *SidecarTemplateCache
+	// Recorder records Events about the injection. When nil no Event is recorded.
+	Recorder record.EventRecorder
+	// Metrics records the Prometheus metrics of the admissions. When nil nothing is recorded.
+	Metrics *Metrics
+	// Certificates serves the TLS keypair, reloaded when the certificate files change.
+	Certificates *CertificateReloader
+	// Logger writes the logs of the admissions. When nil the default logger is used.
+	Logger *slog.Logger
+	// TracerProvider creates the spans of the admissions. When nil the global one is used.
+	TracerProvider trace.TracerProvider
 }
 
 // Webhook Server parameters.
 type WebhookServerParameters struct {
 	Port                int    // Webhook Server port
+	MetricsPort         int    // Plain HTTP port of /metrics, 0 serves it on Port
+	OTLPEndpoint        string // OTLP/gRPC endpoint receiving the spans, tracing is disabled when empty
+	OTLPInsecure        bool   // Send the spans without TLS
 	CertFile            string // Path to the x509 certificate for https
 	KeyFile             string // Path to the x509 private key matching `CertFile`
 	InjectPrefix        string // Annotation prefix
 	InjectName          string // Annotaton inject suffix
 	InjectConfigMapName string // annotation config suffix
+	InjectStatusName    string // annotation status suffix
+	InjectSecretName    string // annotation secret suffix
 	SidecarDataKey      string
+	ConfigMapCache      bool               // Serve ConfigMaps from an informer cache
+	ConfigMapSelector   string             // Label selector limiting the cached ConfigMaps
+	NamespaceAllowlist  NamespaceAllowlist // Cross-namespace sidecar references allowed
+	ConflictPolicy      ConflictPolicy     // Default policy for name conflicts of injected items
+	EnvMode             EnvMode            // Default mode of the ConfigMap env injection
+	EnvMergeStrategy    EnvMergeStrategy   // Default strategy for injected env vars already defined
+	EnvNameValidation   EnvNameValidation  // Validation of the injected env var names
+	FailurePolicy       FailurePolicy      // Default policy for missing or invalid sidecar sources
 }
 
 func failWithResponse(errMsg string) admissionv1.AdmissionResponse {
@@ -78,188 +122,796 @@ type InjectorConfig struct {
 	InjectPrefix        string // Annotation prefix.
 	InjectName          string // Annotaton inject suffix.
 	InjectConfigMapName string // annotation config suffix.
+	InjectStatusName    string // annotation status suffix.
+	InjectSecretName    string // annotation secret suffix.
 	SidecarDataKey      string
+	NamespaceAllowlist  NamespaceAllowlist // Cross-namespace sidecar references allowed.
+	ConflictPolicy      ConflictPolicy     // Default policy for name conflicts of injected items.
+	EnvMode             EnvMode            // Default mode of the ConfigMap env injection.
+	EnvMergeStrategy    EnvMergeStrategy   // Default strategy for injected env vars already defined.
+	EnvNameValidation   EnvNameValidation  // Validation of the injected env var names.
+	FailurePolicy       FailurePolicy      // Default policy for missing or invalid sidecar sources.
 }
 
-func generateEnvs(cm *corev1.ConfigMap) []corev1.EnvVar {
-	var envs []corev1.EnvVar
+// getConfigMap returns the ConfigMap from the cache when enabled, else from the apiserver.
+func (whsvr *WebhookServer) getConfigMap(
+	ctx context.Context,
+	namespace string,
+	name string,
+) (*corev1.ConfigMap, error) {
+	backend := "apiserver"
+	if whsvr.ConfigMaps != nil {
+		backend = "cache"
+	}
+	ctx, span := whsvr.tracer().Start(ctx, "GetConfigMap", trace.WithAttributes(
+		attrSourceNamespace.String(namespace),
+		attrSourceName.String(name),
+		attrBackend.String(backend),
+	))
+	defer span.End()
+
+	start := time.Now()
+	var (
+		cm  *corev1.ConfigMap
+		err error
+	)
+	if whsvr.ConfigMaps != nil {
+		cm, err = whsvr.ConfigMaps.Get(namespace, name)
+	} else {
+		cm, err = whsvr.K8sClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	whsvr.Metrics.observeConfigMapLookup(backend, start, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return cm, err
+}
+
+// getSecretMetadata returns the metadata of the Secret, without reading its data when the
+// MetadataClient is set.
+func (whsvr *WebhookServer) getSecretMetadata(
+	ctx context.Context,
+	namespace string,
+	name string,
+) (*metav1.ObjectMeta, error) {
+	if whsvr.MetadataClient == nil {
+		secret, err := whsvr.K8sClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		return &secret.ObjectMeta, nil
+	}
+
+	secrets := whsvr.MetadataClient.Resource(corev1.SchemeGroupVersion.WithResource("secrets"))
+	secret, err := secrets.Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
 
-	re := regexp.MustCompile(`(?m)^[a-zA-Z_]+[a-zA-Z0-9_]*`)
-	for key, value := range cm.Data {
-		if re.MatchString(key) {
-			envs = append(envs, corev1.EnvVar{Name: key, Value: value, ValueFrom: nil})
+	return &secret.ObjectMeta, nil
+}
+
+// missingSecrets returns the names of the image pull secrets that do not exist in namespace.
+func (whsvr *WebhookServer) missingSecrets(
+	ctx context.Context,
+	namespace string,
+	secrets []corev1.LocalObjectReference,
+) []string {
+	var missing []string
+	for _, secret := range secrets {
+		_, err := whsvr.getSecretMetadata(ctx, namespace, secret.Name)
+		if k8serrors.IsNotFound(err) {
+			missing = append(missing, secret.Name)
+		} else if err != nil {
+			loggerFrom(ctx).Error("Error fetching image pull Secret", "secret", secret.Name, "error", err)
 		}
 	}
 
-	return envs
+	return missing
+}
+
+// configMapSidecars decodes the sidecars stored in the ConfigMap under the data key. The
+// ConfigMaps annotated as templated are rendered for the pod first.
+func (whsvr *WebhookServer) configMapSidecars(
+	cm *corev1.ConfigMap,
+	injectorConfig InjectorConfig,
+	data SidecarTemplateData,
+) ([]Sidecar, error) {
+	var (
+		tmpl     *template.Template
+		sidecars []Sidecar
+		err      error
+	)
+	templated := sidecarsTemplated(cm, injectorConfig.InjectPrefix)
+	if whsvr.ConfigMaps != nil {
+		tmpl, sidecars, err = whsvr.ConfigMaps.Sidecars(cm, injectorConfig.SidecarDataKey, templated)
+	} else {
+		tmpl, sidecars, err = parseSidecars(cm.Namespace+"/"+cm.Name, cm.Data[injectorConfig.SidecarDataKey], templated)
+	}
+	if err != nil || tmpl == nil {
+		return sidecars, err
+	}
+
+	return renderSidecars(tmpl, data)
+}
+
+// sidecarReference is one entry of the inject annotation, "[namespace/]name[:sidecar]".
+// Without namespace the name refers to a SidecarTemplate or a ConfigMap of the pod
+// namespace, otherwise to a ConfigMap of the given namespace. The optional sidecar selects
+// a single entry of the ConfigMap by its name instead of injecting all of them.
+type sidecarReference struct {
+	Namespace string
+	Name      string
+	Sidecar   string
+	// Qualified is set when the namespace was given explicitly.
+	Qualified bool
+}
+
+func (ref sidecarReference) String() string {
+	if ref.Sidecar != "" {
+		return ref.Namespace + "/" + ref.Name + ":" + ref.Sidecar
+	}
+
+	return ref.Namespace + "/" + ref.Name
+}
+
+// parseSidecarReference parses one inject annotation entry, bare names resolve to namespace.
+func parseSidecarReference(value string, namespace string) sidecarReference {
+	ref := sidecarReference{Namespace: namespace, Name: value}
+	if name, sidecar, ok := strings.Cut(ref.Name, ":"); ok {
+		ref.Name = strings.TrimSpace(name)
+		ref.Sidecar = strings.TrimSpace(sidecar)
+	}
+	if refNamespace, name, ok := strings.Cut(ref.Name, "/"); ok {
+		ref.Namespace = refNamespace
+		ref.Name = name
+		ref.Qualified = true
+	}
+
+	return ref
+}
+
+// selectSidecar returns the sidecar called name.
+func selectSidecar(sidecars []Sidecar, name string) (Sidecar, error) {
+	if sidecar, found := lo.Find(sidecars, func(sidecar Sidecar) bool {
+		return sidecar.Name == name
+	}); found {
+		return sidecar, nil
+	}
+
+	available := lo.Map(sidecars, func(sidecar Sidecar, _ int) string {
+		return sidecar.Name
+	})
+
+	return Sidecar{}, fmt.Errorf("sidecar %q not found (available: %s)", name, strings.Join(available, ", "))
 }
 
-func configmapSidecarNames(pod corev1.Pod, injectorConfig InjectorConfig) []string {
+func configmapSidecarRefs(
+	logger *slog.Logger,
+	pod corev1.Pod,
+	namespace string,
+	injectorConfig InjectorConfig,
+) []sidecarReference {
 	injectConfig, err := getAnnotation(&pod.ObjectMeta, injectorConfig.InjectName, injectorConfig.InjectPrefix)
 	if err != nil {
-		log.Printf(
-			"Skipping sidecar inject for %s/%s due missing annotation",
-			pod.Namespace,
-			metaName(&pod.ObjectMeta),
-		)
+		logger.Debug("No sidecar to inject, the inject annotation is missing")
 		return nil
 	}
-	log.Printf(
-		"Sidecar inject for %s/%s config %s due missing annotation",
-		pod.Namespace,
-		metaName(&pod.ObjectMeta),
-		injectConfig,
-	)
-	parts := lo.Map(strings.Split(injectConfig, ","), func(part string, _ int) string {
-		return strings.TrimSpace(part)
+	logger.Debug("Injecting sidecars of the inject annotation", "references", injectConfig)
+	parts := lo.FilterMap(strings.Split(injectConfig, ","), func(part string, _ int) (sidecarReference, bool) {
+		part = strings.TrimSpace(part)
+
+		return parseSidecarReference(part, namespace), part != ""
 	})
 	return parts
 }
 
+// addedSidecar is a sidecar added to the patch, recorded as injected unless conflict
+// resolution drops all its items. object is the source ConfigMap or SidecarTemplate.
+type addedSidecar struct {
+	object  runtime.Object
+	sidecar InjectedSidecar
+	origin  *PatchOrigin
+}
+
 func (whsvr *WebhookServer) HandleAdmissionRequest(
 	injectorConfig InjectorConfig,
 	req *admissionv1.AdmissionRequest,
 	ctx context.Context,
-) admissionv1.AdmissionResponse {
+) (resp admissionv1.AdmissionResponse) {
+	ctx, span := whsvr.tracer().Start(ctx, "HandleAdmissionRequest")
+	defer func() {
+		span.SetAttributes(attrAllowed.Bool(resp.Allowed))
+		if !resp.Allowed && resp.Result != nil {
+			loggerFrom(ctx).Warn("Pod denied", "reason", resp.Result.Message)
+			span.SetStatus(codes.Error, resp.Result.Message)
+		}
+		span.End()
+	}()
+
 	var err error
 	if req == nil {
+		whsvr.logger().Error("Received empty request")
 		return failWithResponse("Received empty request")
 	}
+	logger := whsvr.logger().With("uid", req.UID, "namespace", req.Namespace)
+	span.SetAttributes(
+		semconv.K8SNamespaceName(req.Namespace),
+		attrRequestUID.String(string(req.UID)),
+		attrOperation.String(string(req.Operation)),
+	)
 
 	var pod corev1.Pod
 
 	if err = json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		logger.Error("Could not unmarshal raw object", "error", err)
 		return failWithResponse(
 			fmt.Sprintf("Could not unmarshal raw object: %v", err),
 		)
 	}
+	span.SetAttributes(attrPodGenerateName.String(pod.GenerateName))
 
-	log.Printf(
-		"AdmissionRequest for Version=%s, Kind=%s, Namespace=%v PodName=%v UID=%v rfc6902PatchOperation=%v UserInfo=%v",
-		req.Kind.Version,
-		req.Kind.Kind,
-		req.Namespace,
-		metaName(&pod.ObjectMeta),
-		req.UID,
-		req.Operation,
-		req.UserInfo,
+	logger = logger.With("pod", metaName(&pod.ObjectMeta))
+	ctx = withLogger(ctx, logger)
+
+	logger.Info(
+		"Admission request",
+		"kind", req.Kind.Kind,
+		"version", req.Kind.Version,
+		"operation", req.Operation,
+		"user", redactedUserInfo(req.UserInfo),
 	)
 	// Determine whether to perform mutation.
 	if !mutationRequired(GetIgnoredNamespaces(), &pod.ObjectMeta, injectorConfig) {
-		log.Printf(
-			"Skipping mutation for %s/%s due to policy check",
-			req.Namespace,
-			metaName(&pod.ObjectMeta),
-		)
+		logger.Info("Skipping mutation, not required by the namespace or the annotations")
 
 		return admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 	if req.Operation != admissionv1.Create {
-		log.Printf(
-			"Skipping mutation for %s/%s due to operation check",
-			req.Namespace,
-			metaName(&pod.ObjectMeta),
-		)
+		logger.Info("Skipping mutation, only pod creations are mutated")
 		return admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
 	patchConfig := &PatchConfig{}
-	var configMapName string
+	warnings := &admissionWarnings{logger: logger}
+	dryRun := req.DryRun != nil && *req.DryRun
+	events := whsvr.newInjectionEvents(&pod, req.Namespace, dryRun)
+
+	status := getInjectionStatus(logger, &pod.ObjectMeta, injectorConfig)
+	injected := false
+	var addedSidecars []addedSidecar
+	var presentSidecars []InjectedSidecar
+	// injectSidecar adds the sidecar of source, object is the source ConfigMap or
+	// SidecarTemplate.
+	injectSidecar := func(object runtime.Object, source string, sidecar Sidecar) {
+		if status.hasSidecar(source, sidecar.Name) {
+			logger.Debug("Skipping sidecar already injected", "sidecar", sidecar.Name, "source", source)
+			return
+		}
+		// The containers were added by another injector or the manifest was re-submitted, the
+		// conflict policy only applies to partial collisions.
+		if sidecarPresent(&pod, sidecar) {
+			logger.Debug("Skipping sidecar already present", "sidecar", sidecar.Name, "source", source)
+			presentSidecars = append(presentSidecars, InjectedSidecar{
+				Source: source,
+				Name:   sidecar.Name,
+				Hash:   sidecarHash(sidecar),
+			})
+			return
+		}
+		if sidecar.deprecatedVolumeMounts {
+			warnings.addf(
+				"sidecar %s of ConfigMap %s uses the deprecated vplumeMounts key, use volumeMounts instead",
+				sidecar.Name,
+				source,
+			)
+		}
+		addedSidecars = append(addedSidecars, addedSidecar{
+			object: object,
+			sidecar: InjectedSidecar{
+				Source: source,
+				Name:   sidecar.Name,
+				Hash:   sidecarHash(sidecar),
+			},
+			origin: patchConfig.AddSidecar(sidecar, pod.Spec.Containers),
+		})
+		injected = true
+	}
 
-	configMapName, err = getAnnotation(&pod.ObjectMeta, injectorConfig.InjectConfigMapName, injectorConfig.InjectPrefix)
+	configMapNames, err := getAnnotation(&pod.ObjectMeta, injectorConfig.InjectConfigMapName, injectorConfig.InjectPrefix)
 	if err != nil {
-		log.Printf(
-			"Skipping Env inject for %s/%s annotation not found",
-			req.Namespace,
-			metaName(&pod.ObjectMeta),
-		)
+		logger.Debug("No env ConfigMap to inject, the config annotation is missing")
 	} else {
-		var configmapEnv *corev1.ConfigMap
+		envMode, configMapInjection, optionWarnings := envOptions(
+			&pod,
+			injectorConfig,
+			injectorConfig.InjectConfigMapName,
+			"ConfigMaps "+configMapNames,
+		)
+		warnings.add(optionWarnings...)
+		var sources []envSource
+		sources, err = parseEnvSources(configMapNames)
+		if err != nil {
+			warnings.addf("env ConfigMaps: %v", err)
+		}
 
-		configmapEnv, err = whsvr.K8sClient.CoreV1().
-			ConfigMaps(req.Namespace).
-			Get(ctx, configMapName, metav1.GetOptions{})
-		if k8serrors.IsNotFound(err) {
-			log.Printf(
-				"ConfigMap %s for %s/%s not found",
-				configMapName,
-				req.Namespace,
-				metaName(&pod.ObjectMeta),
-			)
-		} else if err != nil {
-			log.Printf(
-				"Error fetching ConfigMap %s for %s/%s %v",
-				configMapName,
-				req.Namespace,
-				metaName(&pod.ObjectMeta),
-				err,
-			)
-		} else {
-			patchConfig.Envs = generateEnvs(configmapEnv)
+		for _, source := range sources {
+			if status.hasEnv(source.Name) {
+				logger.Debug("Skipping env ConfigMap already injected", "configMap", source.Name)
+				continue
+			}
+
+			var configmapEnv *corev1.ConfigMap
+			configmapEnv, err = whsvr.getConfigMap(ctx, req.Namespace, source.Name)
+			if k8serrors.IsNotFound(err) {
+				logger.Warn("Env ConfigMap not found", "configMap", source.Name)
+				warnings.addf(
+					"ConfigMap %s not found in namespace %s, its env vars are not injected",
+					source.Name,
+					req.Namespace,
+				)
+				events.warningf(
+					nil,
+					ReasonSourceNotFound,
+					"Env ConfigMap %s/%s of pod %s not found",
+					req.Namespace,
+					source.Name,
+					events.pod,
+				)
+				continue
+			} else if err != nil {
+				logger.Error("Error fetching env ConfigMap", "configMap", source.Name, "error", err)
+				warnings.addf("ConfigMap %s not available, its env vars are not injected", source.Name)
+				events.warningf(
+					nil,
+					ReasonSourceFetchFailed,
+					"Error fetching env ConfigMap %s/%s of pod %s: %v",
+					req.Namespace,
+					source.Name,
+					events.pod,
+					err,
+				)
+				continue
+			}
+
+			mode := envMode
+			if mode == EnvModeEnvFrom && len(source.Keys) > 0 {
+				warnings.addf(
+					"key mapping of ConfigMap %s is not supported by env mode %s, using %s",
+					source.Name,
+					EnvModeEnvFrom,
+					EnvModeKeyRef,
+				)
+				mode = EnvModeKeyRef
+			}
+			envs, envFrom, invalidKeys := generateEnvs(configmapEnv, source, mode, injectorConfig.EnvNameValidation)
+			warnings.add(rejectedKeyWarnings(
+				"ConfigMap "+source.Name,
+				invalidKeys,
+				injectorConfig.EnvNameValidation,
+			)...)
+			events.rejectedKeys(configmapEnv, invalidKeys, injectorConfig.EnvNameValidation)
+			injection := configMapInjection
+			injection.Source = "ConfigMap " + source.Name
+			injection.Envs, injection.EnvFrom = envs, envFrom
+			patchConfig.EnvInjections = append(patchConfig.EnvInjections, injection)
+			status.Envs = append(status.Envs, source.Name)
+			events.injected(configmapEnv, "ConfigMap "+req.Namespace+"/"+source.Name, "env vars")
+			injected = true
 		}
 	}
-	if configmapSidecarNames := configmapSidecarNames(pod, injectorConfig); configmapSidecarNames != nil {
-		for _, configmapSidecarName := range configmapSidecarNames {
-			var configmapSidecar *corev1.ConfigMap
-			configmapSidecar, err = whsvr.K8sClient.CoreV1().
-				ConfigMaps(req.Namespace).
-				Get(ctx, configmapSidecarName, metav1.GetOptions{})
+	secretNames, err := getAnnotation(&pod.ObjectMeta, injectorConfig.InjectSecretName, injectorConfig.InjectPrefix)
+	if err == nil {
+		secretMode, secretInjection, optionWarnings := envOptions(
+			&pod,
+			injectorConfig,
+			injectorConfig.InjectSecretName,
+			"Secrets "+secretNames,
+		)
+		secretMode, modeWarnings := secretEnvMode(&pod.ObjectMeta, injectorConfig, secretMode)
+		warnings.add(optionWarnings...)
+		warnings.add(modeWarnings...)
+
+		for _, secretName := range splitList(secretNames) {
+			if status.hasSecret(secretName) {
+				logger.Debug("Skipping env Secret already injected", "secret", secretName)
+				continue
+			}
+
+			var secret *corev1.Secret
+			if secretMode == EnvModeEnvFrom {
+				// envFrom references the whole Secret, only its existence is checked.
+				var secretMeta *metav1.ObjectMeta
+				if secretMeta, err = whsvr.getSecretMetadata(ctx, req.Namespace, secretName); err == nil {
+					secret = &corev1.Secret{ObjectMeta: *secretMeta}
+				}
+			} else {
+				secret, err = whsvr.K8sClient.CoreV1().Secrets(req.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+			}
 			if k8serrors.IsNotFound(err) {
-				log.Printf(
-					"ConfigMap %s for %s/%s not found",
-					configmapSidecarName,
+				logger.Warn("Env Secret not found", "secret", secretName)
+				warnings.addf(
+					"Secret %s not found in namespace %s, its env vars are not injected",
+					secretName,
+					req.Namespace,
+				)
+				events.warningf(
+					nil,
+					ReasonSourceNotFound,
+					"Env Secret %s/%s of pod %s not found",
 					req.Namespace,
-					metaName(&pod.ObjectMeta),
+					secretName,
+					events.pod,
 				)
+				continue
 			} else if err != nil {
-				log.Printf(
-					"Error fetching ConfigMap %s for %s/%s %v",
-					configmapSidecarName,
+				logger.Error("Error fetching env Secret", "secret", secretName, "error", err)
+				warnings.addf("Secret %s not available, its env vars are not injected", secretName)
+				events.warningf(
+					nil,
+					ReasonSourceFetchFailed,
+					"Error fetching env Secret %s/%s of pod %s: %v",
 					req.Namespace,
-					metaName(&pod.ObjectMeta),
+					secretName,
+					events.pod,
 					err,
 				)
-			} else if sidecarsStr, ok := configmapSidecar.Data[injectorConfig.SidecarDataKey]; ok {
-				var sidecars []Sidecar
-				if err = yaml.Unmarshal([]byte(sidecarsStr), &sidecars); err != nil {
-					log.Printf(
-						"Error unmarshalling %s in %s for %s/%s %v",
-						injectorConfig.SidecarDataKey,
-						configmapSidecarName,
-						req.Namespace,
-						metaName(&pod.ObjectMeta),
-						err,
-					)
+				continue
+			}
+
+			envs, envFrom, invalidKeys := generateSecretEnvs(secret, secretMode, injectorConfig.EnvNameValidation)
+			warnings.add(rejectedKeyWarnings(
+				"Secret "+secretName,
+				invalidKeys,
+				injectorConfig.EnvNameValidation,
+			)...)
+			events.rejectedKeys(secret, invalidKeys, injectorConfig.EnvNameValidation)
+			injection := secretInjection
+			injection.Source = "Secret " + secretName
+			injection.Envs, injection.EnvFrom = envs, envFrom
+			patchConfig.EnvInjections = append(patchConfig.EnvInjections, injection)
+			status.Secrets = append(status.Secrets, secretName)
+			events.injected(secret, "Secret "+req.Namespace+"/"+secretName, "env vars")
+			injected = true
+		}
+	}
+	var failurePolicy FailurePolicy
+	// sourceFailed reports a missing or invalid sidecar source, it returns true when the
+	// failure policy denies the pod, else the source is skipped with a warning.
+	sourceFailed := func(ref sidecarReference, sourceErr *sidecarSourceError) bool {
+		if failurePolicy == "" {
+			var policyWarnings []string
+			failurePolicy, policyWarnings = whsvr.failurePolicy(ctx, &pod.ObjectMeta, req.Namespace, injectorConfig)
+			warnings.add(policyWarnings...)
+		}
+		if failurePolicy == FailurePolicyFail {
+			return true
+		}
+		warnings.addf("sidecar %s not injected: %v", ref, sourceErr)
+
+		return false
+	}
+	for _, ref := range configmapSidecarRefs(logger, pod, req.Namespace, injectorConfig) {
+		if !injectorConfig.NamespaceAllowlist.Allowed(ref.Namespace, req.Namespace) {
+			logger.Warn("Sidecar reference denied by the namespace allowlist", "reference", ref.String())
+			sourceErr := &sidecarSourceError{
+				Reason:    metav1.StatusReasonForbidden,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message: fmt.Sprintf(
+					"namespace %s may not reference sidecars of namespace %s",
+					req.Namespace,
+					ref.Namespace,
+				),
+			}
+			if sourceFailed(ref, sourceErr) {
+				return denySidecarSource(sourceErr, injectorConfig, warnings.list())
+			}
+			continue
+		}
+
+		if !ref.Qualified && ref.Sidecar == "" {
+			// The ConfigMap of the same name is only used when the template does not exist.
+			sidecarTemplate, sidecar, err := whsvr.templateSidecar(ctx, ref.Name, dryRun)
+			switch {
+			case err != nil:
+				sourceErr := &sidecarSourceError{
+					Reason:  metav1.StatusReasonInternalError,
+					Kind:    "SidecarTemplate",
+					Name:    ref.Name,
+					Message: fmt.Sprintf("Error fetching SidecarTemplate %s: %v", ref.Name, err),
 				}
-				for _, sidecar := range sidecars {
-					patchConfig.InitContainers = append(patchConfig.InitContainers, sidecar.InitContainers...)
-					patchConfig.Containers = append(patchConfig.Containers, sidecar.Containers...)
-					patchConfig.Volumes = append(patchConfig.Volumes, sidecar.Volumes...)
-					patchConfig.ImagePullSecrets = append(patchConfig.ImagePullSecrets, sidecar.ImagePullSecrets...)
-					patchConfig.Annotations = MergeMaps(patchConfig.Annotations, sidecar.Annotations)
-					patchConfig.Labels = MergeMaps(patchConfig.Labels, sidecar.Labels)
+				if sourceFailed(ref, sourceErr) {
+					return denySidecarSource(sourceErr, injectorConfig, warnings.list())
 				}
+				continue
+			case sidecar != nil:
+				injectSidecar(sidecarTemplate, "SidecarTemplate/"+sidecar.Name, *sidecar)
+				continue
+			case sidecarTemplate != nil:
+				whsvr.Metrics.sidecarParseFailed("SidecarTemplate/" + ref.Name)
+				sourceErr := &sidecarSourceError{
+					Reason:  metav1.StatusReasonInvalid,
+					Kind:    "SidecarTemplate",
+					Name:    ref.Name,
+					Message: fmt.Sprintf("SidecarTemplate %s is invalid, see its Parsed condition", ref.Name),
+				}
+				if sourceFailed(ref, sourceErr) {
+					return denySidecarSource(sourceErr, injectorConfig, warnings.list())
+				}
+				continue
+			}
+		}
+
+		var configmapSidecar *corev1.ConfigMap
+		configmapSidecar, err = whsvr.getConfigMap(ctx, ref.Namespace, ref.Name)
+		if k8serrors.IsNotFound(err) {
+			logger.Warn("Sidecar ConfigMap not found", "reference", ref.String())
+			events.warningf(
+				nil,
+				ReasonSourceNotFound,
+				"Sidecar ConfigMap %s/%s of pod %s not found",
+				ref.Namespace,
+				ref.Name,
+				events.pod,
+			)
+			sourceErr := &sidecarSourceError{
+				Reason:    metav1.StatusReasonNotFound,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message:   fmt.Sprintf("ConfigMap %s/%s not found", ref.Namespace, ref.Name),
+			}
+			if sourceFailed(ref, sourceErr) {
+				return denySidecarSource(sourceErr, injectorConfig, warnings.list())
+			}
+			continue
+		} else if err != nil {
+			logger.Error("Error fetching sidecar ConfigMap", "reference", ref.String(), "error", err)
+			events.warningf(
+				nil,
+				ReasonSourceFetchFailed,
+				"Error fetching sidecar ConfigMap %s/%s of pod %s: %v",
+				ref.Namespace,
+				ref.Name,
+				events.pod,
+				err,
+			)
+			sourceErr := &sidecarSourceError{
+				Reason:    metav1.StatusReasonInternalError,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message:   fmt.Sprintf("Error fetching ConfigMap %s/%s: %v", ref.Namespace, ref.Name, err),
+			}
+			if sourceFailed(ref, sourceErr) {
+				return denySidecarSource(sourceErr, injectorConfig, warnings.list())
+			}
+			continue
+		}
+
+		if _, ok := configmapSidecar.Data[injectorConfig.SidecarDataKey]; !ok {
+			sourceErr := &sidecarSourceError{
+				Reason:    metav1.StatusReasonInvalid,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message: fmt.Sprintf(
+					"ConfigMap %s/%s has no %s key",
+					ref.Namespace,
+					ref.Name,
+					injectorConfig.SidecarDataKey,
+				),
+			}
+			if sourceFailed(ref, sourceErr) {
+				return denySidecarSource(sourceErr, injectorConfig, warnings.list())
 			}
+			continue
+		}
+		var sidecars []Sidecar
+		_, parseSpan := whsvr.tracer().Start(ctx, "ParseSidecars", trace.WithAttributes(
+			attrSourceNamespace.String(ref.Namespace),
+			attrSourceName.String(ref.Name),
+		))
+		sidecars, err = whsvr.configMapSidecars(
+			configmapSidecar,
+			injectorConfig,
+			newSidecarTemplateData(&pod, req.Namespace),
+		)
+		if err != nil {
+			parseSpan.RecordError(err)
+			parseSpan.SetStatus(codes.Error, err.Error())
 		}
+		parseSpan.End()
+		var renderErr *sidecarRenderError
+		if errors.As(err, &renderErr) {
+			whsvr.Metrics.sidecarParseFailed(ref.Namespace + "/" + ref.Name)
+			events.warningf(
+				configmapSidecar,
+				ReasonParseFailed,
+				"Error rendering %s of ConfigMap %s/%s for pod %s: %v",
+				injectorConfig.SidecarDataKey,
+				ref.Namespace,
+				ref.Name,
+				events.pod,
+				err,
+			)
+			// A template error is a mistake of the ConfigMap author, the pod is always denied.
+			return denySidecarSource(&sidecarSourceError{
+				Reason:    metav1.StatusReasonInvalid,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message: fmt.Sprintf(
+					"Error rendering %s in ConfigMap %s/%s: %v",
+					injectorConfig.SidecarDataKey,
+					ref.Namespace,
+					ref.Name,
+					err,
+				),
+			}, injectorConfig, warnings.list())
+		} else if err != nil {
+			logger.Error(
+				"Error decoding sidecars",
+				"reference", ref.String(),
+				"key", injectorConfig.SidecarDataKey,
+				"error", err,
+			)
+			whsvr.Metrics.sidecarParseFailed(ref.Namespace + "/" + ref.Name)
+			events.warningf(
+				configmapSidecar,
+				ReasonParseFailed,
+				"Error decoding %s of ConfigMap %s/%s for pod %s: %v",
+				injectorConfig.SidecarDataKey,
+				ref.Namespace,
+				ref.Name,
+				events.pod,
+				err,
+			)
+			sourceErr := &sidecarSourceError{
+				Reason:    metav1.StatusReasonInvalid,
+				Kind:      "ConfigMap",
+				Namespace: ref.Namespace,
+				Name:      ref.Name,
+				Message: fmt.Sprintf(
+					"Error decoding %s of ConfigMap %s/%s: %v",
+					injectorConfig.SidecarDataKey,
+					ref.Namespace,
+					ref.Name,
+					err,
+				),
+			}
+			if sourceFailed(ref, sourceErr) {
+				return denySidecarSource(sourceErr, injectorConfig, warnings.list())
+			}
+			continue
+		}
+		if ref.Sidecar != "" {
+			var sidecar Sidecar
+			if sidecar, err = selectSidecar(sidecars, ref.Sidecar); err != nil {
+				return denySidecarSource(&sidecarSourceError{
+					Reason:    metav1.StatusReasonInvalid,
+					Kind:      "ConfigMap",
+					Namespace: ref.Namespace,
+					Name:      ref.Name,
+					Message: fmt.Sprintf(
+						"Invalid sidecar reference %s in ConfigMap %s/%s: %v",
+						ref,
+						ref.Namespace,
+						ref.Name,
+						err,
+					),
+				}, injectorConfig, warnings.list())
+			}
+			sidecars = []Sidecar{sidecar}
+		}
+		for _, sidecar := range sidecars {
+			injectSidecar(configmapSidecar, ref.Namespace+"/"+ref.Name, sidecar)
+		}
+	}
+
+	if !injected {
+		logger.Info("Nothing to inject")
+		return admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings.list(),
+		}
+	}
+
+	conflictWarnings, err := resolveConflicts(&pod, patchConfig, injectorConfig.ConflictPolicy)
+	warnings.add(conflictWarnings...)
+	if err != nil {
+		return admissionv1.AdmissionResponse{
+			Warnings: warnings.list(),
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Conflicting sidecar injection: %v", err),
+			},
+		}
+	}
+
+	// A sidecar whose items were all skipped is not recorded, so that a later admission
+	// injects it once the conflict is gone. Present sidecars are recorded only along with
+	// other injections, a pod that only has present sidecars is not mutated.
+	status.Sidecars = append(status.Sidecars, presentSidecars...)
+	var injectedSidecars []InjectedSidecar
+	var injectedTemplates []*v1alpha1.SidecarTemplate
+	for _, added := range addedSidecars {
+		if added.origin.dropped() {
+			logger.Info("Sidecar not injected, all its items conflict", "sidecar", added.sidecar.Name)
+			continue
+		}
+		status.Sidecars = append(status.Sidecars, added.sidecar)
+		injectedSidecars = append(injectedSidecars, added.sidecar)
+		if sidecarTemplate, ok := added.object.(*v1alpha1.SidecarTemplate); ok {
+			injectedTemplates = append(injectedTemplates, sidecarTemplate)
+			events.injected(nil, added.sidecar.Source, "sidecar "+added.sidecar.Name)
+		} else {
+			events.injected(added.object, "ConfigMap "+added.sidecar.Source, "sidecar "+added.sidecar.Name)
+		}
+	}
+	if patchConfig.Annotations == nil {
+		patchConfig.Annotations = map[string]string{}
 	}
+	patchConfig.Annotations[injectorConfig.InjectPrefix+"/"+injectorConfig.InjectStatusName] = status.String()
 
+	envWarnings, err := resolveEnvs(&pod, patchConfig)
+	warnings.add(envWarnings...)
+	if err != nil {
+		return admissionv1.AdmissionResponse{
+			Warnings: warnings.list(),
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Conflicting env injection: %v", err),
+			},
+		}
+	}
+
+	for _, secret := range whsvr.missingSecrets(
+		ctx,
+		req.Namespace,
+		newImagePullSecrets(pod.Spec.ImagePullSecrets, patchConfig.ImagePullSecrets),
+	) {
+		warnings.addf(
+			"imagePullSecret %s of injected sidecars not found in namespace %s",
+			secret,
+			req.Namespace,
+		)
+	}
+
+	_, patchSpan := whsvr.tracer().Start(ctx, "createPatch")
 	patchBytes, err := createPatch(&pod, patchConfig)
+	patchSpan.SetAttributes(attrPatchSize.Int(len(patchBytes)))
+	patchSpan.End()
 	if err != nil {
 		return admissionv1.AdmissionResponse{
+			Warnings: warnings.list(),
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	}
 
-	//log.Printf("AdmissionResponse: patch=%v\n", printPrettyPatch(patchBytes))
+	events.admitted()
+	if !dryRun {
+		whsvr.sidecarTemplatesInjected(ctx, injectedTemplates, events.pod)
+	}
+	whsvr.Metrics.sidecarsInjected(injectedSidecars)
+	span.SetAttributes(attrSidecars.StringSlice(lo.Map(injectedSidecars, func(sidecar InjectedSidecar, _ int) string {
+		return sidecar.Source + ":" + sidecar.Name
+	})))
+	logger.Info("Pod mutated", "sidecars", len(injectedSidecars), "patchSize", len(patchBytes))
+	logger.Debug("Generated patch", "patch", string(patchBytes))
 	return admissionv1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
+		Allowed:  true,
+		Warnings: warnings.list(),
+		Patch:    patchBytes,
 		PatchType: func() *admissionv1.PatchType {
 			pt := admissionv1.PatchTypeJSONPatch
 
@@ -268,12 +920,13 @@ func (whsvr *WebhookServer) HandleAdmissionRequest(
 	}
 }
 
-func (whsvr *WebhookServer) Health(writer http.ResponseWriter, _ *http.Request) {
-	writer.WriteHeader(http.StatusOK)
-}
-
 // Serve method for webhook Server.
 func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
+	// Continue the trace of the apiserver when it sends a traceparent header.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := whsvr.tracer().Start(ctx, "Serve", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	var body []byte
 	if r.Body != nil {
 		if data, err := io.ReadAll(r.Body); err == nil {
@@ -282,7 +935,7 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(body) == 0 {
-		log.Print("empty body")
+		whsvr.logger().Warn("Rejecting admission review with an empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
@@ -290,7 +943,7 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		log.Printf("Content-Type=%s, expecting application/json", contentType)
+		whsvr.logger().Warn("Rejecting admission review, expecting application/json", "contentType", contentType)
 		http.Error(w, "invalid Content-Type, expecting `application/json`", http.StatusUnsupportedMediaType)
 		return
 	}
@@ -298,11 +951,21 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	// Declare AdmissionResponse. This is the value that will be used to craft the
 	// response on this handler.
 	var admissionResponse admissionv1.AdmissionResponse
+	start := time.Now()
 
 	// Decode AdmissionRequest from raw AdmissionReview bytes.
+	_, decodeSpan := whsvr.tracer().Start(ctx, "DecodeAdmissionReview")
 	admissionRequest, err := NewAdmissionRequest(body)
+	decodeSpan.End()
+	if admissionRequest == nil {
+		// The review could not be decoded or has no request, the response has no UID.
+		admissionRequest = &admissionv1.AdmissionRequest{}
+	}
+	logger := whsvr.logger().With("uid", admissionRequest.UID, "namespace", admissionRequest.Namespace)
 	if err != nil {
-		log.Printf("could not decode body: %v", err)
+		logger.Error("Could not decode admission review", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 
 		// Set AdmissionResponse with error message
 		admissionResponse = admissionv1.AdmissionResponse{
@@ -318,10 +981,18 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 				InjectPrefix:        whsvr.Params.InjectPrefix,
 				InjectName:          whsvr.Params.InjectName,
 				InjectConfigMapName: whsvr.Params.InjectConfigMapName,
+				InjectStatusName:    whsvr.Params.InjectStatusName,
+				InjectSecretName:    whsvr.Params.InjectSecretName,
 				SidecarDataKey:      whsvr.Params.SidecarDataKey,
+				NamespaceAllowlist:  whsvr.Params.NamespaceAllowlist,
+				ConflictPolicy:      whsvr.Params.ConflictPolicy,
+				EnvMode:             whsvr.Params.EnvMode,
+				EnvMergeStrategy:    whsvr.Params.EnvMergeStrategy,
+				EnvNameValidation:   whsvr.Params.EnvNameValidation,
+				FailurePolicy:       whsvr.Params.FailurePolicy,
 			},
 			admissionRequest,
-			r.Context(),
+			ctx,
 		)
 	}
 
@@ -329,6 +1000,17 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	// was populated)
 	admissionResponse.UID = admissionRequest.UID
 
+	if err != nil {
+		whsvr.Metrics.observeAdmission(string(admissionRequest.Operation), outcomeInvalid, start, 0)
+	} else {
+		whsvr.Metrics.observeAdmission(
+			string(admissionRequest.Operation),
+			admissionOutcome(&admissionResponse),
+			start,
+			len(admissionResponse.Patch),
+		)
+	}
+
 	// Wrap AdmissonResponse in AdmissionReview, then marshal it to JSON.
 	resp, err := json.Marshal(admissionv1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
@@ -338,13 +1020,13 @@ func (whsvr *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 		Response: &admissionResponse,
 	})
 	if err != nil {
-		log.Printf("could not encode response: %v", err)
+		logger.Error("Could not encode admission response", "error", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
 	}
 
-	log.Printf("Ready to write response ...")
+	logger.Debug("Writing admission response")
 	if _, err := w.Write(resp); err != nil {
-		log.Printf("could not write response: %v", err)
+		logger.Error("Could not write admission response", "error", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
@@ -355,6 +1037,9 @@ func NewAdmissionRequest(reviewRequestBytes []byte) (*admissionv1.AdmissionReque
 	var ar admissionv1.AdmissionReview
 	_, _, err := deserializer.Decode(reviewRequestBytes, nil, &ar)
 
-	log.Printf("Received AdmissionReview, APIVersion: %s, Kind: %s\n", ar.APIVersion, ar.Kind)
+	slog.Debug("Received AdmissionReview", "apiVersion", ar.APIVersion, "kind", ar.Kind)
+	if err == nil && ar.Request == nil {
+		err = errors.New("admission review has no request")
+	}
 	return ar.Request, err
 }
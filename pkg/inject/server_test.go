@@ -1,10 +1,26 @@
 package inject
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 type injectionTestCase struct {
@@ -25,6 +41,36 @@ func TestEnvInjectInjection(t *testing.T) {
 			annotatedPodTemplateSpecPath:        "./testdata/invalid-env-annotated-pod.json",
 			expectedInjectedPodTemplateSpecPath: "./testdata/invalid-env-mutated-pod.json",
 		},
+		{
+			description:                         "Env targets",
+			annotatedPodTemplateSpecPath:        "./testdata/env-targets-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/env-targets-mutated-pod.json",
+		},
+		{
+			description:                         "Env from",
+			annotatedPodTemplateSpecPath:        "./testdata/env-from-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/env-from-mutated-pod.json",
+		},
+		{
+			description:                         "Env key ref",
+			annotatedPodTemplateSpecPath:        "./testdata/env-key-ref-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/env-key-ref-mutated-pod.json",
+		},
+		{
+			description:                         "Secret",
+			annotatedPodTemplateSpecPath:        "./testdata/secret-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/secret-mutated-pod.json",
+		},
+		{
+			description:                         "Env order",
+			annotatedPodTemplateSpecPath:        "./testdata/env-order-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/env-order-mutated-pod.json",
+		},
+		{
+			description:                         "Env sources",
+			annotatedPodTemplateSpecPath:        "./testdata/env-sources-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/env-sources-mutated-pod.json",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -52,6 +98,249 @@ func TestEnvInjectInjection(t *testing.T) {
 		})
 	}
 }
+func TestEnvMode(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/env-key-ref-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{
+		`key "1TEST1" of ConfigMap invalid-test-config is not a valid env var name under strict validation, not injected`,
+	}, resp.Warnings)
+
+	mode, err := ParseEnvMode("EnvFrom")
+	assert.NoError(t, err)
+	assert.Equal(t, EnvModeEnvFrom, mode)
+	_, err = ParseEnvMode("secret")
+	assert.Error(t, err)
+
+	injectorConfig := testInjectorConfig()
+	injectorConfig.EnvMode = EnvModeKeyRef
+	mode, err = getEnvMode(&metav1.ObjectMeta{
+		Annotations: map[string]string{"injector.server-lab.info/config-mode": "copy"},
+	}, injectorConfig, "config")
+	assert.EqualError(t, err, `invalid env mode "copy", expecting one of value, envFrom, keyRef`)
+	assert.Equal(t, EnvModeKeyRef, mode)
+}
+
+func TestSecretEnvInjection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/secret-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, string(resp.Patch), "s3cr3t")
+	assert.Equal(t, []string{
+		`key "db.host" of Secret db-credentials is not a valid env var name under strict validation, not injected`,
+		"Secret missing-credentials not found in namespace dummy, its env vars are not injected",
+	}, resp.Warnings)
+
+	secret := credentialsSecret("dummy", "db-credentials")
+	envs, envFrom, invalid := generateSecretEnvs(&secret, EnvModeEnvFrom, EnvNameStrict)
+	assert.Empty(t, envs)
+	assert.Equal(t, []corev1.EnvFromSource{{
+		SecretRef: &corev1.SecretEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"},
+		},
+	}}, envFrom)
+	assert.Equal(t, []string{"db.host"}, invalid)
+
+	// envFrom only checks that the Secret exists, through its metadata.
+	admissionReq := ownedAdmissionRequest(t, "./testdata/secret-annotated-pod.json", map[string]string{
+		"injector.server-lab.info/secret-mode": "envFrom",
+	})
+	if admissionReq == nil {
+		return
+	}
+	whsvr := newTestWebhookServer()
+	resp = whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, context.Background())
+	assert.True(t, resp.Allowed)
+	assert.Contains(t, string(resp.Patch), `"secretRef":{"name":"db-credentials"}`)
+	assert.Equal(t, []string{
+		"Secret missing-credentials not found in namespace dummy, its env vars are not injected",
+	}, resp.Warnings)
+	for _, action := range whsvr.K8sClient.(*fake.Clientset).Actions() {
+		assert.False(t, action.Matches("get", "secrets"), "unexpected Secret GET")
+	}
+
+	mode, warnings := secretEnvMode(&metav1.ObjectMeta{
+		Annotations: map[string]string{"injector.server-lab.info/secret-mode": "value"},
+	}, testInjectorConfig(), EnvModeValue)
+	assert.Equal(t, EnvModeKeyRef, mode)
+	assert.Equal(t, []string{"env mode value is not supported for Secrets, using keyRef"}, warnings)
+}
+
+func TestEnvMergeInjection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/env-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{
+		"existing env var TEST1 of container nginx-2 overridden by ConfigMap test-config",
+	}, resp.Warnings)
+
+	req, err = newTestAdmissionRequest("./testdata/env-merge-fail-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err = sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, resp.Allowed)
+	assert.Equal(
+		t,
+		"Conflicting env injection: env var TEST1 of ConfigMap test-config conflicts with an existing env var of container nginx-2",
+		resp.Result.Message,
+	)
+}
+
+func TestParseEnvSources(t *testing.T) {
+	sources, err := parseEnvSources("shared, db-settings:HOST=DB_HOST; PORT=DB_PORT, cache:prefix=CACHE_;bad, :x")
+	assert.EqualError(
+		t,
+		err,
+		`invalid option "bad" of ConfigMap cache, expecting KEY=NAME or prefix=PREFIX, missing ConfigMap name in ":x"`,
+	)
+	assert.Equal(t, []envSource{
+		{Name: "shared"},
+		{Name: "db-settings", Keys: map[string]string{"HOST": "DB_HOST", "PORT": "DB_PORT"}},
+		{Name: "cache", Prefix: "CACHE_"},
+	}, sources)
+	assert.Equal(t, "DB_HOST", sources[1].envName("HOST"))
+	assert.Equal(t, "USER", sources[1].envName("USER"))
+	assert.Equal(t, "CACHE_TTL", sources[2].envName("TTL"))
+
+	cm := configMap("dummy", "test-config")
+	_, envFrom, invalid := generateEnvs(&cm, sources[2], EnvModeEnvFrom, EnvNameStrict)
+	assert.Empty(t, invalid)
+	assert.Equal(t, "CACHE_", envFrom[0].Prefix)
+}
+
+func TestEnvModesKeyValidation(t *testing.T) {
+	cm := configMap("dummy", "test-config")
+	cm.Data["FOO.BAR"] = "value-4"
+	names := func(envs []corev1.EnvVar) []string {
+		return lo.Map(envs, func(env corev1.EnvVar, _ int) string { return env.Name })
+	}
+
+	// The mode only decides how the keys are injected, never which keys are.
+	for _, mode := range []EnvMode{EnvModeValue, EnvModeKeyRef, EnvModeEnvFrom} {
+		t.Run(string(mode), func(t *testing.T) {
+			envs, _, invalid := generateEnvs(&cm, envSource{Name: cm.Name}, mode, EnvNameStrict)
+			assert.Equal(t, []string{"FOO.BAR"}, invalid)
+			assert.NotContains(t, names(envs), "FOO.BAR")
+
+			envs, _, invalid = generateEnvs(&cm, envSource{Name: cm.Name}, mode, EnvNameRelaxed)
+			assert.Empty(t, invalid)
+			if mode != EnvModeEnvFrom {
+				assert.Contains(t, names(envs), "FOO.BAR")
+			}
+		})
+	}
+}
+
+func TestEnvNameValidation(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/secret-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	admissionReq, err := NewAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	whsvr := newTestWebhookServer()
+	whsvr.Recorder = recorder
+	resp := whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, context.Background())
+	assert.Contains(t, resp.Warnings,
+		`key "db.host" of Secret db-credentials is not a valid env var name under strict validation, not injected`,
+	)
+	assert.Equal(t, []string{
+		"Warning InvalidEnvKeys Keys db.host are not valid env var names under strict validation " +
+			"and were not injected into pod dummy/nginx-deployment-6c54bd5869-",
+		"Normal Injected Injected env vars into pod dummy/nginx-deployment-6c54bd5869-",
+	}, recordedEvents(recorder))
+
+	injectorConfig := testInjectorConfig()
+	injectorConfig.EnvNameValidation = EnvNameRelaxed
+	resp = whsvr.HandleAdmissionRequest(injectorConfig, admissionReq, context.Background())
+	assert.Equal(t, []string{
+		"Secret missing-credentials not found in namespace dummy, its env vars are not injected",
+	}, resp.Warnings)
+	assert.Contains(t, string(resp.Patch), `"name":"db.host"`)
+	assert.Equal(t, []string{
+		"Normal Injected Injected env vars into pod dummy/nginx-deployment-6c54bd5869-",
+	}, recordedEvents(recorder))
+
+	assert.True(t, EnvNameRelaxed.valid("FOO.BAR"))
+	assert.True(t, EnvNameRelaxed.valid("a-b"))
+	assert.False(t, EnvNameRelaxed.valid("1ABC"))
+	assert.False(t, EnvNameStrict.valid("FOO.BAR"))
+	assert.True(t, EnvNameStrict.valid("_FOO_1"))
+
+	validation, err := ParseEnvNameValidation("Relaxed")
+	assert.NoError(t, err)
+	assert.Equal(t, EnvNameRelaxed, validation)
+	_, err = ParseEnvNameValidation("none")
+	assert.Error(t, err)
+}
+
+func TestEnvTargets(t *testing.T) {
+	injectorConfig := testInjectorConfig()
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"injector.server-lab.info/config-containers":         "app, worker, [",
+				"injector.server-lab.info/config-exclude-containers": "istio-*",
+				"injector.server-lab.info/config-include-init":       "yes",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}, {Name: "istio-proxy"}},
+		},
+	}
+
+	targets, err := getEnvTargets(&pod.ObjectMeta, injectorConfig, "config")
+	assert.EqualError(t, err, `invalid container pattern "[" in config-containers, invalid boolean "yes" in config-include-init`)
+	assert.Equal(t, EnvTargets{
+		Containers:        []string{"app", "worker"},
+		ExcludeContainers: []string{"istio-*"},
+	}, targets)
+	assert.True(t, targets.Selects("app"))
+	assert.False(t, targets.Selects("istio-proxy"))
+	assert.False(t, targets.Selects("sidecar"))
+	assert.Equal(t, []string{"worker"}, targets.unmatched(&pod))
+
+	targets, err = getEnvTargets(&metav1.ObjectMeta{}, injectorConfig, "config")
+	assert.NoError(t, err)
+	assert.True(t, targets.Selects("anything"))
+
+	// Patterns that cannot be honoured select no container rather than every one.
+	for annotation, value := range map[string]string{
+		"injector.server-lab.info/config-containers":         "[app",
+		"injector.server-lab.info/config-exclude-containers": "istio-*, [",
+	} {
+		targets, err = getEnvTargets(&metav1.ObjectMeta{
+			Annotations: map[string]string{annotation: value},
+		}, injectorConfig, "config")
+		assert.ErrorContains(t, err, "env vars are injected into no container")
+		assert.True(t, targets.None)
+		assert.False(t, targets.Selects("app"))
+	}
+}
+
 func TestMissingAnnotations(t *testing.T) {
 	var testCases = []injectionTestCase{
 		{
@@ -142,3 +431,670 @@ func TestBothInjection(t *testing.T) {
 		})
 	}
 }
+
+func TestSidecarTemplateInjection(t *testing.T) {
+	var testCases = []injectionTestCase{
+		{
+			description:                         "SidecarTemplate",
+			annotatedPodTemplateSpecPath:        "./testdata/template-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/template-mutated-pod.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			req, err := newTestAdmissionRequest(
+				tc.annotatedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			expectedMod, err := os.ReadFile(
+				tc.expectedInjectedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			mod, err := applyPatchToAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.JSONEq(t, string(expectedMod), string(mod))
+		})
+	}
+}
+
+func TestSidecarTemplateStatus(t *testing.T) {
+	whsvr := &WebhookServer{
+		K8sClient:     fake.NewSimpleClientset(),
+		DynamicClient: newTestDynamicClient(),
+	}
+	ctx := context.Background()
+	condition := func(name string, conditionType string) func() *metav1.Condition {
+		return func() *metav1.Condition {
+			template, err := whsvr.getSidecarTemplate(ctx, name)
+			if err != nil {
+				return nil
+			}
+
+			return meta.FindStatusCondition(template.Status.Conditions, conditionType)
+		}
+	}
+
+	// Resolving a template does not write its status, the pod may still be denied.
+	template, sidecar, err := whsvr.templateSidecar(ctx, "sidecar-template", false)
+	assert.NoError(t, err)
+	assert.NotNil(t, template)
+	if assert.NotNil(t, sidecar) {
+		assert.Equal(t, "sidecar-template", sidecar.Name)
+	}
+	assert.Never(t, func() bool { return condition("sidecar-template", v1alpha1.ConditionParsed)() != nil },
+		100*time.Millisecond, 10*time.Millisecond)
+
+	// Denied pods do not mark the template injected.
+	injectorConfig := testInjectorConfig()
+	injectorConfig.FailurePolicy = FailurePolicyFail
+	resp := whsvr.HandleAdmissionRequest(
+		injectorConfig,
+		ownedAdmissionRequest(t, "./testdata/template-annotated-pod.json", map[string]string{
+			"injector.server-lab.info/inject": "sidecar-template, missing-sidecar",
+		}),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Never(t, func() bool { return condition("sidecar-template", v1alpha1.ConditionInjected)() != nil },
+		100*time.Millisecond, 10*time.Millisecond)
+
+	// Dry-run requests do not write the template status.
+	admissionReq := ownedAdmissionRequest(t, "./testdata/template-annotated-pod.json", nil)
+	if admissionReq == nil {
+		return
+	}
+	admissionReq.DryRun = lo.ToPtr(true)
+	resp = whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, ctx)
+	assert.True(t, resp.Allowed)
+	assert.Never(t, func() bool { return condition("sidecar-template", v1alpha1.ConditionInjected)() != nil },
+		100*time.Millisecond, 10*time.Millisecond)
+
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/template-annotated-pod.json", nil),
+		ctx,
+	)
+	assert.True(t, resp.Allowed)
+	assert.Eventually(t, func() bool {
+		injected := condition("sidecar-template", v1alpha1.ConditionInjected)()
+		parsed := condition("sidecar-template", v1alpha1.ConditionParsed)()
+		return injected != nil && injected.Status == metav1.ConditionTrue &&
+			parsed != nil && parsed.Status == metav1.ConditionTrue
+	}, 5*time.Second, 10*time.Millisecond)
+
+	template, sidecar, err = whsvr.templateSidecar(ctx, "broken-template", false)
+	assert.NoError(t, err)
+	assert.NotNil(t, template)
+	assert.Nil(t, sidecar)
+	assert.Eventually(t, func() bool { return condition("broken-template", v1alpha1.ConditionParsed)() != nil },
+		5*time.Second, 10*time.Millisecond)
+	if parsed := condition("broken-template", v1alpha1.ConditionParsed)(); assert.NotNil(t, parsed) {
+		assert.Equal(t, metav1.ConditionFalse, parsed.Status)
+		assert.Equal(t, v1alpha1.ReasonParseError, parsed.Reason)
+		assert.Equal(t, int64(1), parsed.ObservedGeneration)
+	}
+
+	template, sidecar, err = whsvr.templateSidecar(ctx, "sidecar-config", false)
+	assert.NoError(t, err)
+	assert.Nil(t, template)
+	assert.Nil(t, sidecar)
+}
+
+func TestCrossNamespaceInjection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/cross-namespace-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	expectedMod, err := os.ReadFile("./testdata/cross-namespace-mutated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mod, err := applyPatchToAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, string(expectedMod), string(mod))
+
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"sidecar restricted/sidecar-config not injected: namespace dummy may not reference sidecars of namespace restricted",
+	}, resp.Warnings)
+}
+
+func TestNamespaceAllowlist(t *testing.T) {
+	allowlist := NamespaceAllowlist{}
+	assert.NoError(t, allowlist.Set("platform=team-*, shared"))
+	assert.NoError(t, allowlist.Set("catalog=*"))
+	assert.Error(t, allowlist.Set("platform"))
+	assert.Error(t, allowlist.Set("platform=["))
+
+	assert.True(t, allowlist.Allowed("platform", "team-a"))
+	assert.True(t, allowlist.Allowed("platform", "shared"))
+	assert.False(t, allowlist.Allowed("platform", "other"))
+	assert.True(t, allowlist.Allowed("catalog", "other"))
+	assert.True(t, allowlist.Allowed("other", "other"))
+	assert.False(t, allowlist.Allowed("other", "team-a"))
+	assert.Equal(t, "catalog=* platform=team-*,shared", allowlist.String())
+}
+
+func TestSidecarSelection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/catalog-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	expectedMod, err := os.ReadFile("./testdata/catalog-mutated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mod, err := applyPatchToAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, string(expectedMod), string(mod))
+}
+
+func TestUnknownSidecarSelection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/catalog-unknown-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, resp.Allowed)
+	assert.Empty(t, resp.Patch)
+	assert.Equal(
+		t,
+		`Invalid sidecar reference dummy/sidecar-catalog:tracing-agent in ConfigMap dummy/sidecar-catalog: `+
+			`sidecar "tracing-agent" not found (available: log-agent, metrics-agent)`,
+		resp.Result.Message,
+	)
+}
+
+func TestParseSidecarReference(t *testing.T) {
+	assert.Equal(t,
+		sidecarReference{Namespace: "dummy", Name: "sidecars"},
+		parseSidecarReference("sidecars", "dummy"),
+	)
+	assert.Equal(t,
+		sidecarReference{Namespace: "platform", Name: "sidecars", Qualified: true},
+		parseSidecarReference("platform/sidecars", "dummy"),
+	)
+	assert.Equal(t,
+		sidecarReference{Namespace: "dummy", Name: "sidecars", Sidecar: "log-agent"},
+		parseSidecarReference("sidecars:log-agent", "dummy"),
+	)
+	assert.Equal(t,
+		sidecarReference{Namespace: "platform", Name: "sidecars", Sidecar: "log-agent", Qualified: true},
+		parseSidecarReference("platform/sidecars:log-agent", "dummy"),
+	)
+}
+
+func TestTemplatedSidecarInjection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/templated-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	expectedMod, err := os.ReadFile("./testdata/templated-mutated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mod, err := applyPatchToAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, string(expectedMod), string(mod))
+}
+
+func TestBrokenTemplateSidecarInjection(t *testing.T) {
+	req, err := newTestAdmissionRequest("./testdata/broken-template-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := sendAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, resp.Allowed)
+	assert.Equal(
+		t,
+		`Error rendering sidecars.yaml in ConfigMap dummy/broken-template-sidecar: `+
+			`template: dummy/broken-template-sidecar:4: function "unknownFunc" not defined`,
+		resp.Result.Message,
+	)
+}
+
+func TestReinvocationInjection(t *testing.T) {
+	var testCases = []injectionTestCase{
+		{
+			description:                  "Recorded in status",
+			annotatedPodTemplateSpecPath: "./testdata/mixed-mutated-pod.json",
+		},
+		{
+			description:                  "Present by container name",
+			annotatedPodTemplateSpecPath: "./testdata/sidecar-present-pod.json",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			req, err := newTestAdmissionRequest(
+				tc.annotatedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, err := sendAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, resp.Allowed)
+			assert.Empty(t, resp.Patch)
+		})
+	}
+}
+
+func TestPresentSidecarRecorded(t *testing.T) {
+	// The present sidecar is not injected again, but recorded along with the env injection.
+	admissionReq := ownedAdmissionRequest(t, "./testdata/sidecar-present-pod.json", map[string]string{
+		"injector.server-lab.info/config": "test-config",
+	})
+	if admissionReq == nil {
+		return
+	}
+	resp := newTestWebhookServer().HandleAdmissionRequest(testInjectorConfig(), admissionReq, context.Background())
+	assert.True(t, resp.Allowed)
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mutated, err := patch.Apply(admissionReq.Object.Raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var pod corev1.Pod
+	if assert.NoError(t, json.Unmarshal(mutated, &pod)) {
+		assert.Len(t, pod.Spec.Containers, 3)
+		assert.Contains(t, pod.Annotations["injector.server-lab.info/status"], `"source":"dummy/sidecar-config"`)
+	}
+}
+
+func TestVolumeMountsInjection(t *testing.T) {
+	var testCases = []injectionTestCase{
+		{
+			description:                         "Volume mounts",
+			annotatedPodTemplateSpecPath:        "./testdata/volume-mounts-annotated-pod.json",
+			expectedInjectedPodTemplateSpecPath: "./testdata/volume-mounts-mutated-pod.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			req, err := newTestAdmissionRequest(
+				tc.annotatedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			expectedMod, err := os.ReadFile(
+				tc.expectedInjectedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			mod, err := applyPatchToAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.JSONEq(t, string(expectedMod), string(mod))
+
+			resp, err := sendAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Contains(t, resp.Warnings, "sidecar legacy-agent of ConfigMap dummy/shared-volume-sidecar "+
+				"uses the deprecated vplumeMounts key, use volumeMounts instead")
+		})
+	}
+}
+
+func TestVolumeMountTargets(t *testing.T) {
+	mount := SidecarVolumeMount{
+		Containers:        []string{"app-*", "worker"},
+		ExcludeContainers: []string{"app-debug"},
+	}
+	assert.True(t, volumeMountTargets(mount, "app-web"))
+	assert.True(t, volumeMountTargets(mount, "worker"))
+	assert.False(t, volumeMountTargets(mount, "app-debug"))
+	assert.False(t, volumeMountTargets(mount, "proxy"))
+	assert.True(t, volumeMountTargets(SidecarVolumeMount{}, "proxy"))
+}
+
+func TestImagePullSecretsInjection(t *testing.T) {
+	var testCases = []struct {
+		description                  string
+		annotatedPodTemplateSpecPath string
+		expectedImagePullSecrets     []string
+	}{
+		{
+			description:                  "Without pod secrets",
+			annotatedPodTemplateSpecPath: "./testdata/pull-secrets-annotated-pod.json",
+			expectedImagePullSecrets:     []string{"regcred", "missing-cred"},
+		},
+		{
+			description:                  "With pod secrets",
+			annotatedPodTemplateSpecPath: "./testdata/pull-secrets-existing-annotated-pod.json",
+			expectedImagePullSecrets:     []string{"app-cred", "regcred", "missing-cred"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			req, err := newTestAdmissionRequest(
+				tc.annotatedPodTemplateSpecPath,
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			mod, err := applyPatchToAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var pod corev1.Pod
+			if !assert.NoError(t, json.Unmarshal(mod, &pod)) {
+				return
+			}
+			assert.Equal(t, tc.expectedImagePullSecrets, lo.Map(
+				pod.Spec.ImagePullSecrets,
+				func(secret corev1.LocalObjectReference, _ int) string { return secret.Name },
+			))
+
+			admissionReq, err := NewAdmissionRequest(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			whsvr := newTestWebhookServer()
+			resp := whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, context.Background())
+			assert.Equal(t, []string{
+				"imagePullSecret missing-cred of injected sidecars not found in namespace dummy",
+			}, resp.Warnings)
+			// Only the metadata of the Secrets is read.
+			for _, action := range whsvr.K8sClient.(*fake.Clientset).Actions() {
+				assert.False(t, action.Matches("get", "secrets"), "unexpected Secret GET")
+			}
+		})
+	}
+}
+
+// ownedAdmissionRequest reads the pod of the admission request and sets the annotations and
+// a ReplicaSet controller on it.
+func ownedAdmissionRequest(t *testing.T, path string, annotations map[string]string) *admissionv1.AdmissionRequest {
+	req, err := newTestAdmissionRequest(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	admissionReq, err := NewAdmissionRequest(req)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	var pod corev1.Pod
+	if !assert.NoError(t, json.Unmarshal(admissionReq.Object.Raw, &pod)) {
+		return nil
+	}
+	for key, value := range annotations {
+		pod.Annotations[key] = value
+	}
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "ReplicaSet",
+		Name:       "nginx-deployment-6c54bd5869",
+		UID:        "replicaset-uid",
+		Controller: lo.ToPtr(true),
+	}}
+	admissionReq.Object.Raw, err = json.Marshal(&pod)
+	assert.NoError(t, err)
+
+	return admissionReq
+}
+
+func TestInjectionEvents(t *testing.T) {
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	whsvr := newTestWebhookServer()
+	whsvr.Recorder = recorder
+
+	admissionReq := ownedAdmissionRequest(t, "./testdata/mixed-annotated-pod.json", map[string]string{
+		"injector.server-lab.info/inject": "sidecar-config, missing-sidecar",
+	})
+	if admissionReq == nil {
+		return
+	}
+	var pod corev1.Pod
+	_ = json.Unmarshal(admissionReq.Object.Raw, &pod)
+	assert.Equal(t, &corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "ReplicaSet",
+		Namespace:  "dummy",
+		Name:       "nginx-deployment-6c54bd5869",
+		UID:        "replicaset-uid",
+	}, workloadReference(&pod, "dummy"))
+
+	resp := whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, ctx)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"Warning SourceNotFound Sidecar ConfigMap dummy/missing-sidecar of pod dummy/nginx-deployment-6c54bd5869- not found",
+		"Normal Injected Injected env vars into pod dummy/nginx-deployment-6c54bd5869-",
+		"Normal Injected Injected sidecar haystack-agent into pod dummy/nginx-deployment-6c54bd5869-",
+		"Normal Injected Injected env vars of ConfigMap dummy/test-config; " +
+			"sidecar haystack-agent of ConfigMap dummy/sidecar-config into pod dummy/nginx-deployment-6c54bd5869-",
+	}, recordedEvents(recorder))
+
+	admissionReq = ownedAdmissionRequest(t, "./testdata/broken-template-annotated-pod.json", nil)
+	if admissionReq == nil {
+		return
+	}
+	resp = whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, ctx)
+	assert.False(t, resp.Allowed)
+	parseFailed := "Warning ParseFailed Error rendering sidecars.yaml of ConfigMap dummy/broken-template-sidecar " +
+		"for pod dummy/nginx-deployment-6c54bd5869-: " +
+		`template: dummy/broken-template-sidecar:4: function "unknownFunc" not defined`
+	// Recorded on the ConfigMap and on the ReplicaSet, no Injected Event for a denied pod.
+	assert.Equal(t, []string{parseFailed, parseFailed}, recordedEvents(recorder))
+
+	// Dry-run requests have no side effects.
+	admissionReq = ownedAdmissionRequest(t, "./testdata/mixed-annotated-pod.json", map[string]string{
+		"injector.server-lab.info/inject": "sidecar-config, missing-sidecar",
+	})
+	if admissionReq == nil {
+		return
+	}
+	admissionReq.DryRun = lo.ToPtr(true)
+	resp = whsvr.HandleAdmissionRequest(testInjectorConfig(), admissionReq, ctx)
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, recordedEvents(recorder))
+
+	pod.OwnerReferences = nil
+	assert.Nil(t, workloadReference(&pod, "dummy"))
+}
+
+func TestFailurePolicy(t *testing.T) {
+	ctx := context.Background()
+	missing := map[string]string{"injector.server-lab.info/inject": "missing-sidecar"}
+	withPolicy := func(annotations map[string]string, policy string) map[string]string {
+		annotations = lo.Assign(annotations)
+		annotations["injector.server-lab.info/inject-failure-policy"] = policy
+
+		return annotations
+	}
+
+	whsvr := newTestWebhookServer()
+	resp := whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", missing),
+		ctx,
+	)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"sidecar dummy/missing-sidecar not injected: ConfigMap dummy/missing-sidecar not found",
+	}, resp.Warnings)
+
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", withPolicy(missing, "Fail")),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: "ConfigMap dummy/missing-sidecar not found",
+		Reason:  metav1.StatusReasonNotFound,
+		Code:    404,
+		Details: &metav1.StatusDetails{
+			Name: "missing-sidecar",
+			Kind: "ConfigMap",
+			Causes: []metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldValueNotFound,
+				Message: "ConfigMap dummy/missing-sidecar not found",
+				Field:   "metadata.annotations[injector.server-lab.info/inject]",
+			}},
+		},
+	}, resp.Result)
+
+	// A ConfigMap without sidecars.yaml is invalid.
+	injectorConfig := testInjectorConfig()
+	injectorConfig.FailurePolicy = FailurePolicyFail
+	resp = whsvr.HandleAdmissionRequest(
+		injectorConfig,
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", map[string]string{
+			"injector.server-lab.info/inject": "test-config",
+		}),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, metav1.StatusReasonInvalid, resp.Result.Reason)
+	assert.Equal(t, int32(422), resp.Result.Code)
+	assert.Equal(t, "ConfigMap dummy/test-config has no sidecars.yaml key", resp.Result.Message)
+
+	// The pod annotation can make the namespace policy stricter, not weaker.
+	_, err := whsvr.K8sClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "dummy",
+			Annotations: map[string]string{"injector.server-lab.info/inject-failure-policy": "fail"},
+		},
+	}, metav1.CreateOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", missing),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", withPolicy(missing, "ignore")),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", withPolicy(missing, "maybe")),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, []string{
+		`pod annotation injector.server-lab.info/inject-failure-policy: ` +
+			`invalid failure policy "maybe", expecting one of ignore, fail`,
+	}, resp.Warnings)
+
+	// Pods referencing only valid sources never look the policy up.
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", withPolicy(nil, "maybe")),
+		ctx,
+	)
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Warnings)
+
+	// A Namespace that cannot be read fails closed.
+	whsvr = newTestWebhookServer()
+	failGet := func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	}
+	whsvr.K8sClient.(*fake.Clientset).PrependReactor("get", "namespaces", failGet)
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", missing),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, "ConfigMap dummy/missing-sidecar not found", resp.Result.Message)
+	assert.Equal(t, []string{
+		"failure policy of namespace dummy unknown, failing: connection refused",
+	}, resp.Warnings)
+
+	// References denied by the allowlist and SidecarTemplates that cannot be fetched fail
+	// like missing sources.
+	injectorConfig = testInjectorConfig()
+	injectorConfig.FailurePolicy = FailurePolicyFail
+	whsvr = newTestWebhookServer()
+	resp = whsvr.HandleAdmissionRequest(
+		injectorConfig,
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", map[string]string{
+			"injector.server-lab.info/inject": "restricted/sidecar-config",
+		}),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, metav1.StatusReasonForbidden, resp.Result.Reason)
+	assert.Equal(t, int32(403), resp.Result.Code)
+	assert.Equal(t, "namespace dummy may not reference sidecars of namespace restricted", resp.Result.Message)
+
+	whsvr.DynamicClient.(*dynamicfake.FakeDynamicClient).PrependReactor("get", "sidecartemplates", failGet)
+	resp = whsvr.HandleAdmissionRequest(
+		injectorConfig,
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", nil),
+		ctx,
+	)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, "Error fetching SidecarTemplate sidecar-config: connection refused", resp.Result.Message)
+	resp = whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/sidecar-annotated-pod.json", nil),
+		ctx,
+	)
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Patch)
+	assert.Equal(t, []string{
+		"sidecar dummy/sidecar-config not injected: Error fetching SidecarTemplate sidecar-config: connection refused",
+	}, resp.Warnings)
+
+	policy, err := ParseFailurePolicy(" FAIL")
+	assert.NoError(t, err)
+	assert.Equal(t, FailurePolicyFail, policy)
+	_, err = ParseFailurePolicy("open")
+	assert.Error(t, err)
+}
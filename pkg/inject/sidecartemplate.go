@@ -0,0 +1,215 @@
+package inject
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// sidecarTemplateStatusTimeout bounds the background write of a SidecarTemplate status.
+const sidecarTemplateStatusTimeout = 10 * time.Second
+
+// getSidecarTemplate returns the cluster-scoped SidecarTemplate called name, from the cache
+// when set. It returns nil without error when no dynamic client is configured, the CRD is
+// not installed or the template does not exist, so that the caller can fall back to the
+// ConfigMap lookup.
+func (whsvr *WebhookServer) getSidecarTemplate(
+	ctx context.Context,
+	name string,
+) (*v1alpha1.SidecarTemplate, error) {
+	if whsvr.DynamicClient == nil {
+		return nil, nil
+	}
+	if whsvr.SidecarTemplates != nil {
+		return whsvr.SidecarTemplates.Get(name)
+	}
+
+	obj, err := whsvr.DynamicClient.Resource(v1alpha1.SidecarTemplateResource).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var template v1alpha1.SidecarTemplate
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &template); err != nil {
+		return nil, fmt.Errorf("could not decode SidecarTemplate %s: %w", name, err)
+	}
+
+	return &template, nil
+}
+
+// sidecarFromTemplate validates the template spec and converts it to a Sidecar.
+func sidecarFromTemplate(template *v1alpha1.SidecarTemplate) (Sidecar, error) {
+	spec := template.Spec
+	if len(spec.Containers) == 0 && len(spec.InitContainers) == 0 {
+		return Sidecar{}, fmt.Errorf("spec must define at least one container or init container")
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for idx, container := range containers {
+			if container.Name == "" {
+				return Sidecar{}, fmt.Errorf("container %d has no name", idx)
+			}
+			if container.Image == "" {
+				return Sidecar{}, fmt.Errorf("container %s has no image", container.Name)
+			}
+		}
+	}
+
+	for idx, mount := range spec.VolumeMounts {
+		if mount.Name == "" || mount.MountPath == "" {
+			return Sidecar{}, fmt.Errorf("volume mount %d needs a name and a mountPath", idx)
+		}
+		for _, pattern := range append(mount.Containers, mount.ExcludeContainers...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return Sidecar{}, fmt.Errorf("volume mount %s has an invalid container pattern %q: %w", mount.Name, pattern, err)
+			}
+		}
+	}
+
+	var policy ConflictPolicy
+	if spec.ConflictPolicy != "" {
+		var err error
+		if policy, err = ParseConflictPolicy(spec.ConflictPolicy); err != nil {
+			return Sidecar{}, err
+		}
+	}
+
+	return Sidecar{
+		Name:             template.Name,
+		InitContainers:   spec.InitContainers,
+		Containers:       spec.Containers,
+		Volumes:          spec.Volumes,
+		ImagePullSecrets: spec.ImagePullSecrets,
+		Annotations:      spec.Annotations,
+		Labels:           spec.Labels,
+		VolumeMounts:     spec.VolumeMounts,
+		ConflictPolicy:   policy,
+	}, nil
+}
+
+// templateSidecar resolves name as a SidecarTemplate. The template is nil when it does not
+// exist and the ConfigMap of the same name should be used instead, the sidecar is nil when
+// the template is invalid, and the error is set when the template cannot be fetched. Parse
+// errors are recorded in the template status in the background, unless the request is a
+// dry run.
+func (whsvr *WebhookServer) templateSidecar(
+	ctx context.Context,
+	name string,
+	dryRun bool,
+) (*v1alpha1.SidecarTemplate, *Sidecar, error) {
+	template, err := whsvr.getSidecarTemplate(ctx, name)
+	if err != nil {
+		loggerFrom(ctx).Error("Error fetching SidecarTemplate", "sidecarTemplate", name, "error", err)
+
+		return nil, nil, err
+	}
+	if template == nil {
+		return nil, nil, nil
+	}
+
+	sidecar, err := sidecarFromTemplate(template)
+	if err != nil {
+		loggerFrom(ctx).Error("Error parsing SidecarTemplate", "sidecarTemplate", name, "error", err)
+		if !dryRun {
+			whsvr.updateSidecarTemplateStatus(ctx, template, metav1.Condition{
+				Type:    v1alpha1.ConditionParsed,
+				Status:  metav1.ConditionFalse,
+				Reason:  v1alpha1.ReasonParseError,
+				Message: err.Error(),
+			})
+		}
+
+		return template, nil, nil
+	}
+
+	return template, &sidecar, nil
+}
+
+// sidecarTemplatesInjected records in the status of the templates that they were injected
+// into pod, once the admission is known to be allowed.
+func (whsvr *WebhookServer) sidecarTemplatesInjected(
+	ctx context.Context,
+	templates []*v1alpha1.SidecarTemplate,
+	pod string,
+) {
+	templates = lo.UniqBy(templates, func(template *v1alpha1.SidecarTemplate) string { return template.Name })
+	for _, template := range templates {
+		whsvr.updateSidecarTemplateStatus(ctx, template,
+			metav1.Condition{
+				Type:    v1alpha1.ConditionParsed,
+				Status:  metav1.ConditionTrue,
+				Reason:  v1alpha1.ReasonParsed,
+				Message: "Template is valid",
+			},
+			metav1.Condition{
+				Type:    v1alpha1.ConditionInjected,
+				Status:  metav1.ConditionTrue,
+				Reason:  v1alpha1.ReasonInjected,
+				Message: "Injected into " + pod,
+			},
+		)
+	}
+}
+
+// updateSidecarTemplateStatus sets the conditions of the template in the background, so
+// that the admission does not wait for the write. The template must not be used afterwards.
+func (whsvr *WebhookServer) updateSidecarTemplateStatus(
+	ctx context.Context,
+	template *v1alpha1.SidecarTemplate,
+	conditions ...metav1.Condition,
+) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sidecarTemplateStatusTimeout)
+	go func() {
+		defer cancel()
+		whsvr.setSidecarTemplateCondition(ctx, template, conditions...)
+	}()
+}
+
+// setSidecarTemplateCondition updates the template status with the given conditions. The
+// status is only written when a condition changes status, reason or observed generation,
+// so that busy templates do not cause one write per admission.
+func (whsvr *WebhookServer) setSidecarTemplateCondition(
+	ctx context.Context,
+	template *v1alpha1.SidecarTemplate,
+	conditions ...metav1.Condition,
+) {
+	changed := false
+	for _, condition := range conditions {
+		condition.ObservedGeneration = template.Generation
+		existing := meta.FindStatusCondition(template.Status.Conditions, condition.Type)
+		if existing != nil &&
+			existing.Status == condition.Status &&
+			existing.Reason == condition.Reason &&
+			existing.ObservedGeneration == condition.ObservedGeneration {
+			continue
+		}
+		meta.SetStatusCondition(&template.Status.Conditions, condition)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+	if err == nil {
+		obj := &unstructured.Unstructured{Object: content}
+		obj.SetGroupVersionKind(v1alpha1.SchemeGroupVersion.WithKind("SidecarTemplate"))
+		_, err = whsvr.DynamicClient.Resource(v1alpha1.SidecarTemplateResource).
+			UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Error updating status of SidecarTemplate", "sidecarTemplate", template.Name, "error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package inject
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InjectionStatus is recorded in the status annotation of mutated pods. Sidecars, env
+// ConfigMaps and Secrets listed there are not injected again, so that a reinvocation of
+// the webhook on an already mutated pod is a no-op.
+type InjectionStatus struct {
+	Sidecars []InjectedSidecar `json:"sidecars,omitempty"`
+	Envs     []string          `json:"envs,omitempty"`
+	Secrets  []string          `json:"secrets,omitempty"`
+}
+
+// InjectedSidecar identifies one injected sidecar.
+type InjectedSidecar struct {
+	// Source is "namespace/name" of the ConfigMap or "SidecarTemplate/name".
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	// Hash is the hash of the sidecar definition at injection time.
+	Hash string `json:"hash"`
+}
+
+// getInjectionStatus reads the status annotation, an invalid annotation is ignored.
+func getInjectionStatus(
+	logger *slog.Logger,
+	metadata *metav1.ObjectMeta,
+	injectorConfig InjectorConfig,
+) InjectionStatus {
+	var status InjectionStatus
+
+	value, err := getAnnotation(metadata, injectorConfig.InjectStatusName, injectorConfig.InjectPrefix)
+	if err != nil {
+		return status
+	}
+	if err = json.Unmarshal([]byte(value), &status); err != nil {
+		logger.Warn("Ignoring invalid injection status", "error", err)
+	}
+
+	return status
+}
+
+func (s *InjectionStatus) hasSidecar(source, name string) bool {
+	return lo.ContainsBy(s.Sidecars, func(injected InjectedSidecar) bool {
+		return injected.Source == source && injected.Name == name
+	})
+}
+
+// sidecarPresent reports whether all containers of the sidecar already exist in the pod.
+func sidecarPresent(pod *corev1.Pod, sidecar Sidecar) bool {
+	if len(sidecar.Containers) == 0 && len(sidecar.InitContainers) == 0 {
+		return false
+	}
+	hasContainer := func(containers []corev1.Container) func(corev1.Container) bool {
+		return func(container corev1.Container) bool {
+			return lo.ContainsBy(containers, func(existing corev1.Container) bool {
+				return existing.Name == container.Name
+			})
+		}
+	}
+	return lo.EveryBy(sidecar.Containers, hasContainer(pod.Spec.Containers)) &&
+		lo.EveryBy(sidecar.InitContainers, hasContainer(pod.Spec.InitContainers))
+}
+
+func (s *InjectionStatus) hasEnv(name string) bool {
+	return lo.Contains(s.Envs, name)
+}
+
+func (s *InjectionStatus) hasSecret(name string) bool {
+	return lo.Contains(s.Secrets, name)
+}
+
+func (s *InjectionStatus) String() string {
+	value, _ := json.Marshal(s)
+
+	return string(value)
+}
+
+// sidecarHash returns a short hash of the sidecar definition.
+func sidecarHash(sidecar Sidecar) string {
+	value, _ := json.Marshal(sidecar)
+	sum := sha256.Sum256(value)
+
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,142 @@
+package inject
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotation suffixes of the env annotations selecting the env injection targets, e.g.
+// "<prefix>/config-containers: app,worker".
+const (
+	envContainersSuffix        = "-containers"
+	envExcludeContainersSuffix = "-exclude-containers"
+	envIncludeInitSuffix       = "-include-init"
+)
+
+// EnvTargets selects the pod containers receiving the injected env vars. The patterns
+// apply to the init containers as well when IncludeInit is set.
+type EnvTargets struct {
+	// Containers are path.Match patterns of container names, every container when empty.
+	Containers []string
+	// ExcludeContainers are patterns of container names never receiving the env vars.
+	ExcludeContainers []string
+	// IncludeInit also injects the env vars into the init containers.
+	IncludeInit bool
+	// None selects no container. It is set when the patterns cannot be honoured: every
+	// include pattern or one exclude pattern is invalid.
+	None bool
+}
+
+// containerSelected reports whether name matches one of the include patterns, or include
+// is empty, and none of the exclude patterns.
+func containerSelected(name string, include, exclude []string) bool {
+	matches := func(patterns []string) bool {
+		return lo.ContainsBy(patterns, func(pattern string) bool {
+			matched, _ := path.Match(pattern, name)
+
+			return matched
+		})
+	}
+
+	if matches(exclude) {
+		return false
+	}
+
+	return len(include) == 0 || matches(include)
+}
+
+// Selects reports whether the container called name receives the env vars.
+func (t EnvTargets) Selects(name string) bool {
+	if t.None {
+		return false
+	}
+
+	return containerSelected(name, t.Containers, t.ExcludeContainers)
+}
+
+// unmatched returns the container patterns matching none of the candidate containers.
+func (t EnvTargets) unmatched(pod *corev1.Pod) []string {
+	candidates := pod.Spec.Containers
+	if t.IncludeInit {
+		candidates = append(candidates[:len(candidates):len(candidates)], pod.Spec.InitContainers...)
+	}
+
+	return lo.Filter(t.Containers, func(pattern string, _ int) bool {
+		return !lo.ContainsBy(candidates, func(container corev1.Container) bool {
+			return containerSelected(container.Name, []string{pattern}, nil)
+		})
+	})
+}
+
+// splitList splits a comma separated annotation value, dropping empty entries.
+func splitList(value string) []string {
+	return lo.FilterMap(strings.Split(value, ","), func(part string, _ int) (string, bool) {
+		part = strings.TrimSpace(part)
+
+		return part, part != ""
+	})
+}
+
+// getEnvTargets reads the target annotations of the env annotation name. Invalid values
+// are returned as an error next to the targets parsed from the valid ones. Invalid
+// patterns fail closed: when no include pattern or not every exclude pattern is valid,
+// the env vars are injected into no container rather than into unintended ones.
+func getEnvTargets(
+	metadata *metav1.ObjectMeta,
+	injectorConfig InjectorConfig,
+	name string,
+) (EnvTargets, error) {
+	var targets EnvTargets
+	var errs []string
+
+	annotation := func(suffix string) string {
+		value, _ := getAnnotation(metadata, name+suffix, injectorConfig.InjectPrefix)
+
+		return value
+	}
+	validPatterns := func(suffix string) ([]string, bool) {
+		patterns := splitList(annotation(suffix))
+		valid := lo.Filter(patterns, func(pattern string, _ int) bool {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Sprintf(
+					"invalid container pattern %q in %s%s", pattern, name, suffix,
+				))
+				return false
+			}
+
+			return true
+		})
+
+		return valid, len(valid) == len(patterns)
+	}
+
+	containers, allValid := validPatterns(envContainersSuffix)
+	excludeContainers, allExcludeValid := validPatterns(envExcludeContainersSuffix)
+	targets.Containers = containers
+	targets.ExcludeContainers = excludeContainers
+	if (!allValid && len(containers) == 0) || !allExcludeValid {
+		targets.None = true
+		errs = append(errs, "env vars are injected into no container")
+	}
+	if value := annotation(envIncludeInitSuffix); value != "" {
+		includeInit, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf(
+				"invalid boolean %q in %s%s", value, name, envIncludeInitSuffix,
+			))
+		}
+		targets.IncludeInit = includeInit
+	}
+
+	if len(errs) > 0 {
+		return targets, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return targets, nil
+}
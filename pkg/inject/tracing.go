@@ -0,0 +1,62 @@
+package inject
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the webhook spans.
+const tracerName = "github.com/expediagroup/kubernetes-sidecar-injector/pkg/inject"
+
+// Span attributes of the admission spans, the namespace uses k8s.namespace.name.
+const (
+	attrPodGenerateName = attribute.Key("k8s.pod.generate_name")
+	attrRequestUID      = attribute.Key("admission.request.uid")
+	attrOperation       = attribute.Key("admission.operation")
+	attrAllowed         = attribute.Key("admission.allowed")
+	attrSidecars        = attribute.Key("injector.sidecars")
+	attrSourceNamespace = attribute.Key("injector.source.namespace")
+	attrSourceName      = attribute.Key("injector.source.name")
+	attrBackend         = attribute.Key("injector.configmap.backend")
+	attrPatchSize       = attribute.Key("injector.patch.size")
+)
+
+// NewOTLPExporter creates an exporter sending spans over OTLP/gRPC to endpoint, the
+// OTEL_EXPORTER_OTLP_* environment variables apply to the other settings.
+func NewOTLPExporter(ctx context.Context, endpoint string, insecure bool) (sdktrace.SpanExporter, error) {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+
+	return otlptracegrpc.New(ctx, options...)
+}
+
+// NewTracerProvider creates a TracerProvider batching the spans to exporter, e.g. an OTLP,
+// stdout or in-memory exporter. Shutdown flushes the remaining spans.
+func NewTracerProvider(exporter sdktrace.SpanExporter, version string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(eventComponent),
+			semconv.ServiceVersion(version),
+		)),
+	)
+}
+
+// tracer returns the tracer of the server TracerProvider, else of the global one.
+func (whsvr *WebhookServer) tracer() trace.Tracer {
+	if whsvr.TracerProvider != nil {
+		return whsvr.TracerProvider.Tracer(tracerName)
+	}
+
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
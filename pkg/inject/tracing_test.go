@@ -0,0 +1,72 @@
+package inject
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	return lo.SliceToMap(span.Attributes, func(kv attribute.KeyValue) (attribute.Key, attribute.Value) {
+		return kv.Key, kv.Value
+	})
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	whsvr := newTestWebhookServer()
+	whsvr.Params = WebhookServerParameters{
+		InjectPrefix:        "injector.server-lab.info",
+		InjectName:          "inject",
+		InjectConfigMapName: "config",
+		InjectStatusName:    "status",
+		InjectSecretName:    "secret",
+		SidecarDataKey:      "sidecars.yaml",
+	}
+	whsvr.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	req, err := newTestAdmissionRequest("./testdata/mixed-annotated-pod.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(req))
+	httpReq.Header.Set("Content-Type", "application/json")
+	whsvr.Serve(httptest.NewRecorder(), httpReq)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, []string{
+		"DecodeAdmissionReview",
+		"GetConfigMap",
+		"GetConfigMap",
+		"ParseSidecars",
+		"createPatch",
+		"HandleAdmissionRequest",
+		"Serve",
+	}, lo.Map(spans, func(span tracetest.SpanStub, _ int) string { return span.Name }))
+
+	serve, handle := spans[6], spans[5]
+	for _, span := range spans[:6] {
+		assert.Equal(t, serve.SpanContext.TraceID(), span.SpanContext.TraceID())
+	}
+	assert.Equal(t, handle.SpanContext.SpanID(), spans[1].Parent.SpanID())
+
+	attributes := spanAttributes(handle)
+	assert.Equal(t, "dummy", attributes["k8s.namespace.name"].AsString())
+	assert.Equal(t, "nginx-deployment-6c54bd5869-", attributes[attrPodGenerateName].AsString())
+	assert.Equal(t, "0df28fbd-5f5f-11e8-bc74-36e6bb280816", attributes[attrRequestUID].AsString())
+	assert.Equal(t, "CREATE", attributes[attrOperation].AsString())
+	assert.True(t, attributes[attrAllowed].AsBool())
+	assert.Equal(t, []string{"dummy/sidecar-config:haystack-agent"}, attributes[attrSidecars].AsStringSlice())
+
+	attributes = spanAttributes(spans[1])
+	assert.Equal(t, "test-config", attributes[attrSourceName].AsString())
+	assert.Equal(t, "apiserver", attributes[attrBackend].AsString())
+	assert.Positive(t, spanAttributes(spans[4])[attrPatchSize].AsInt64())
+}
@@ -3,15 +3,31 @@ package inject
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"os"
+	"path/filepath"
+	"testing"
 	"text/template"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/expediagroup/kubernetes-sidecar-injector/pkg/apis/injector/v1alpha1"
 	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/record"
 )
 
 // applyPatchToAdmissionRequest runs an AdmissionRequest (wrapped in an AdmissionReview)
@@ -22,21 +38,8 @@ func applyPatchToAdmissionRequest(reviewRequestBytes []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	cm := configMap("dummy", "test-config")
-	icm := invalidConfigMap("dummy", "invalid-test-config")
-	scm := sidecarconfigMap("dummy", "sidecar-config")
-	client := fake.NewSimpleClientset(&cm, &scm, &icm)
-
-	whsvr := &WebhookServer{
-		K8sClient: client,
-	}
-	admissionRes := whsvr.HandleAdmissionRequest(
-		InjectorConfig{
-			InjectPrefix:        "injector.server-lab.info",
-			InjectName:          "inject",
-			InjectConfigMapName: "config",
-			SidecarDataKey:      "sidecars.yaml",
-		},
+	admissionRes := newTestWebhookServer().HandleAdmissionRequest(
+		testInjectorConfig(),
 		req,
 		context.Background(),
 	)
@@ -53,23 +56,66 @@ func sendAdmissionRequest(reviewRequestBytes []byte) (admissionv1.AdmissionRespo
 	if err != nil {
 		return admissionv1.AdmissionResponse{}, err
 	}
+
+	return newTestWebhookServer().HandleAdmissionRequest(
+		testInjectorConfig(),
+		req,
+		context.Background(),
+	), nil
+}
+
+// newTestWebhookServer creates a WebhookServer backed by fake clients holding the test
+// ConfigMaps and SidecarTemplates.
+func newTestWebhookServer() *WebhookServer {
 	cm := configMap("dummy", "test-config")
+	icm := invalidConfigMap("dummy", "invalid-test-config")
+	scm := sidecarconfigMap("dummy", "sidecar-config")
+	pscm := sidecarconfigMap("platform", "sidecar-config")
+	rscm := sidecarconfigMap("restricted", "sidecar-config")
+	ccm := sidecarCatalogConfigMap("dummy", "sidecar-catalog")
+	tcm := templatedSidecarConfigMap("dummy", "templated-sidecar")
+	btcm := brokenTemplateSidecarConfigMap("dummy", "broken-template-sidecar")
+	pcm := privateSidecarConfigMap("dummy", "private-sidecar")
+	vcm := sharedVolumeSidecarConfigMap("dummy", "shared-volume-sidecar")
+	regcred := v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "dummy", Name: "regcred"}}
+	dbSecret := credentialsSecret("dummy", "db-credentials")
+	dcm := dependentConfigMap("dummy", "dependent-config")
+	client := fake.NewSimpleClientset(&cm, &scm, &icm, &pscm, &rscm, &ccm, &tcm, &btcm, &pcm, &vcm, &regcred, &dbSecret, &dcm)
 
-	client := fake.NewSimpleClientset(&cm)
+	return &WebhookServer{
+		K8sClient:      client,
+		DynamicClient:  newTestDynamicClient(),
+		MetadataClient: newTestMetadataClient(&regcred, &dbSecret),
+	}
+}
 
-	whsvr := &WebhookServer{
-		K8sClient: client,
+// newTestMetadataClient creates a fake metadata client holding the metadata of the Secrets.
+func newTestMetadataClient(secrets ...*v1.Secret) *metadatafake.FakeMetadataClient {
+	scheme := metadatafake.NewTestScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+	objects := make([]runtime.Object, 0, len(secrets))
+	for _, secret := range secrets {
+		objects = append(objects, &metav1.PartialObjectMetadata{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: secret.ObjectMeta,
+		})
 	}
-	return whsvr.HandleAdmissionRequest(
-		InjectorConfig{
-			InjectPrefix:        "injector.server-lab.info",
-			InjectName:          "inject",
-			InjectConfigMapName: "config",
-			SidecarDataKey:      "sidecars.yaml",
+
+	return metadatafake.NewSimpleMetadataClient(scheme, objects...)
+}
+
+func testInjectorConfig() InjectorConfig {
+	return InjectorConfig{
+		InjectPrefix:        "injector.server-lab.info",
+		InjectName:          "inject",
+		InjectConfigMapName: "config",
+		InjectStatusName:    "status",
+		InjectSecretName:    "secret",
+		SidecarDataKey:      "sidecars.yaml",
+		NamespaceAllowlist: NamespaceAllowlist{
+			"platform": {"dum*"},
 		},
-		req,
-		context.Background(),
-	), nil
+	}
 }
 
 func configMap(namespace, name string) v1.ConfigMap {
@@ -85,6 +131,19 @@ func configMap(namespace, name string) v1.ConfigMap {
 		},
 	}
 }
+func dependentConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Data: map[string]string{
+			"DB_URL":  "postgres://$(DB_HOST):$(DB_PORT)",
+			"DB_HOST": "db.example.com",
+			"DB_PORT": "5432",
+		},
+	}
+}
 func invalidConfigMap(namespace, name string) v1.ConfigMap {
 	return v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -116,6 +175,214 @@ func sidecarconfigMap(namespace, name string) v1.ConfigMap {
 	}
 }
 
+func sidecarCatalogConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: log-agent
+  containers:
+    - name: log-agent
+      image: fluent/fluent-bit:2.1
+- name: metrics-agent
+  containers:
+    - name: metrics-agent
+      image: prom/statsd-exporter:v0.24.0
+`,
+		},
+	}
+}
+
+func templatedSidecarConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				"injector.server-lab.info/templated": "true",
+			},
+		},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: log-agent
+  containers:
+    - name: log-agent
+      image: fluent/fluent-bit:2.1
+      env:
+        - name: POD_APP
+          value: {{ .ObjectMeta.Labels.app | quote }}
+        - name: POD_NAMESPACE
+          value: {{ .Namespace }}
+        - name: LOG_FORMAT
+          value: {{ index .ObjectMeta.Annotations "log-agent/format" | default "text" }}
+        - name: LOG_CONTAINERS
+          value: {{ range $i, $c := .Containers }}{{ if $i }},{{ end }}{{ $c.Name }}{{ end }}
+        - name: SERVICE_ACCOUNT
+          value: {{ .ServiceAccount | default "default" }}
+`,
+		},
+	}
+}
+
+func brokenTemplateSidecarConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				"injector.server-lab.info/templated": "true",
+			},
+		},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: log-agent
+  containers:
+    - name: log-agent
+      image: {{ .Image | unknownFunc }}
+`,
+		},
+	}
+}
+
+func privateSidecarConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: private-agent
+  containers:
+    - name: private-agent
+      image: registry.example.com/private-agent:1.0
+  imagePullSecrets:
+    - name: regcred
+    - name: missing-cred
+- name: private-shipper
+  containers:
+    - name: private-shipper
+      image: registry.example.com/private-shipper:1.0
+  imagePullSecrets:
+    - name: regcred
+`,
+		},
+	}
+}
+
+func sharedVolumeSidecarConfigMap(namespace, name string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{
+			"sidecars.yaml": `- name: log-shipper
+  containers:
+    - name: log-shipper
+      image: fluent/fluent-bit:2.1
+      volumeMounts:
+        - name: app-logs
+          mountPath: /var/log/app
+          readOnly: true
+  volumes:
+    - name: app-logs
+      emptyDir: {}
+  volumeMounts:
+    - name: app-logs
+      mountPath: /var/log/app
+      excludeContainers:
+        - debug
+    - name: app-logs
+      mountPath: /var/log/nginx
+      subPath: nginx
+      containers:
+        - nginx-*
+- name: legacy-agent
+  containers:
+    - name: legacy-agent
+      image: legacy-agent:1.0
+  vplumeMounts:
+    - name: app-logs
+      mountPath: /etc/legacy-agent
+      containers:
+        - nginx-2
+`,
+		},
+	}
+}
+
+func credentialsSecret(namespace, name string) v1.Secret {
+	return v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Data: map[string][]byte{
+			"DB_USER":     []byte("app"),
+			"DB_PASSWORD": []byte("s3cr3t-password"),
+			"db.host":     []byte("db.example.com"),
+		},
+	}
+}
+
+func sidecarTemplate(name string) v1alpha1.SidecarTemplate {
+	return v1alpha1.SidecarTemplate{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "SidecarTemplate",
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Generation: 1,
+		},
+		Spec: v1alpha1.SidecarTemplateSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "log-agent",
+					Image: "fluent/fluent-bit:2.1",
+				},
+			},
+			Annotations: map[string]string{
+				"log-agent/format": "json",
+			},
+			Labels: map[string]string{
+				"log-agent": "enabled",
+			},
+		},
+	}
+}
+
+func invalidSidecarTemplate(name string) v1alpha1.SidecarTemplate {
+	return v1alpha1.SidecarTemplate{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "SidecarTemplate",
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Generation: 1,
+		},
+		Spec: v1alpha1.SidecarTemplateSpec{
+			Containers: []v1.Container{
+				{
+					Name: "no-image",
+				},
+			},
+		},
+	}
+}
+
+// newTestDynamicClient creates a fake dynamic client serving the test SidecarTemplates.
+func newTestDynamicClient() dynamic.Interface {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	template := sidecarTemplate("sidecar-template")
+	invalidTemplate := invalidSidecarTemplate("broken-template")
+
+	return dynamicfake.NewSimpleDynamicClient(scheme, &template, &invalidTemplate)
+}
+
 // newTestAdmissionRequest creates an Admission Request (wrapped in a Admission Review).
 // This is done by embedding a pod template spec, whose path is an argument, inside the
 // shell of an example Admission Request. This method simplifies generating test
@@ -147,3 +414,52 @@ func newTestAdmissionRequest(podTemplateSpecPath string) ([]byte, error) {
 
 	return reqPrettyJSON.Bytes(), nil
 }
+
+// recordedEvents drains the Events recorded so far.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+
+	return events
+}
+
+// writeTestKeyPair writes a self-signed certificate valid from notBefore to notAfter and its
+// key to cert.pem and key.pem of dir. The files are replaced atomically.
+func writeTestKeyPair(t *testing.T, dir string, serial int64, notBefore, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "k8-injector.default.svc"},
+		DNSNames:     []string{"k8-injector.default.svc"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path+".tmp", pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return certFile, keyFile
+}
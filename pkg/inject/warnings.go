@@ -0,0 +1,83 @@
+package inject
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Limits of the admission warnings. kubectl prints each warning on its own line and the
+// apiserver truncates long warnings, so they are kept short and few.
+const (
+	maxWarningLength = 256
+	maxWarnings      = 10
+)
+
+// admissionWarnings collects the non-fatal problems of one admission, returned to the
+// client as AdmissionResponse.Warnings.
+type admissionWarnings struct {
+	logger   *slog.Logger
+	messages []string
+	seen     map[string]bool
+}
+
+// add records the messages, whitespace is collapsed and duplicates are dropped.
+func (w *admissionWarnings) add(messages ...string) {
+	for _, message := range messages {
+		message = strings.Join(strings.Fields(message), " ")
+		if message == "" || w.seen[message] {
+			continue
+		}
+		if w.seen == nil {
+			w.seen = map[string]bool{}
+		}
+		w.seen[message] = true
+		w.messages = append(w.messages, message)
+	}
+}
+
+// addf records a formatted message.
+func (w *admissionWarnings) addf(format string, args ...interface{}) {
+	w.add(fmt.Sprintf(format, args...))
+}
+
+// list returns the warnings truncated to maxWarningLength characters. Past maxWarnings
+// the remaining ones are replaced by a count and only logged.
+func (w *admissionWarnings) list() []string {
+	if len(w.messages) == 0 {
+		return nil
+	}
+
+	messages := w.messages
+	var omitted []string
+	if len(messages) > maxWarnings {
+		messages, omitted = messages[:maxWarnings-1], messages[maxWarnings-1:]
+	}
+
+	warnings := make([]string, 0, len(messages)+1)
+	for _, message := range messages {
+		warnings = append(warnings, truncateWarning(message))
+	}
+	if len(omitted) > 0 {
+		logger := w.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		for _, message := range omitted {
+			logger.Warn("Omitted admission warning", "warning", message)
+		}
+		warnings = append(warnings, fmt.Sprintf("%d more warnings omitted, see the injector logs", len(omitted)))
+	}
+
+	return warnings
+}
+
+// truncateWarning shortens message to maxWarningLength characters.
+func truncateWarning(message string) string {
+	runes := []rune(message)
+	if len(runes) <= maxWarningLength {
+		return message
+	}
+
+	return string(runes[:maxWarningLength-3]) + "..."
+}
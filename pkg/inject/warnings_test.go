@@ -0,0 +1,51 @@
+package inject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionWarnings(t *testing.T) {
+	warnings := &admissionWarnings{}
+	assert.Nil(t, warnings.list())
+
+	warnings.add("volume config of sidecar a not injected", "", "  volume config of sidecar a\n not injected ")
+	warnings.addf("sidecar %s not injected", "b")
+	warnings.add(strings.Repeat("x", 300))
+	list := warnings.list()
+	assert.Equal(t, []string{
+		"volume config of sidecar a not injected",
+		"sidecar b not injected",
+		strings.Repeat("x", 253) + "...",
+	}, list)
+
+	warnings = &admissionWarnings{}
+	for i := 0; i < 15; i++ {
+		warnings.addf("warning %d", i)
+	}
+	list = warnings.list()
+	assert.Len(t, list, maxWarnings)
+	assert.Equal(t, "warning 8", list[8])
+	assert.Equal(t, "6 more warnings omitted, see the injector logs", list[9])
+}
+
+func TestMissingSourceWarnings(t *testing.T) {
+	whsvr := newTestWebhookServer()
+	resp := whsvr.HandleAdmissionRequest(
+		testInjectorConfig(),
+		ownedAdmissionRequest(t, "./testdata/env-annotated-pod.json", map[string]string{
+			"injector.server-lab.info/config": "missing-config, test-config",
+			"injector.server-lab.info/secret": "missing-credentials, missing-credentials",
+		}),
+		context.Background(),
+	)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{
+		"ConfigMap missing-config not found in namespace dummy, its env vars are not injected",
+		"Secret missing-credentials not found in namespace dummy, its env vars are not injected",
+		"existing env var TEST1 of container nginx-2 overridden by ConfigMap test-config",
+	}, resp.Warnings)
+}
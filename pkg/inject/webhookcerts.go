@@ -0,0 +1,546 @@
+package inject
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Keys of the certificate Secret. ca.crt holds the signing CA first, followed by the
+// previous CAs until they expire, so that it can be used as caBundle during a rotation.
+const (
+	secretCACert = "ca.crt"
+	secretCAKey  = "ca.key"
+)
+
+// Defaults of the self-managed certificates.
+const (
+	DefaultCAValidity   = 10 * 365 * 24 * time.Hour
+	DefaultCertValidity = 365 * 24 * time.Hour
+	DefaultRenewBefore  = 30 * 24 * time.Hour
+)
+
+// caPropagationDelay is the time left to the apiserver to pick up a caBundle holding a new
+// CA, before the serving certificate is signed by it.
+const caPropagationDelay = time.Minute
+
+// certificateResync bounds the time between two reconciliations of the leader, so that a
+// caBundle reset by a redeployment of the MutatingWebhookConfiguration is restored.
+const certificateResync = 10 * time.Minute
+
+// Leader election timings of the certificate rotation.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// SelfManagedCertConfig configures the certificates generated by the webhook itself.
+type SelfManagedCertConfig struct {
+	Namespace         string        // Namespace of the Secret, the Lease and the Service
+	SecretName        string        // Secret holding the CA and the serving certificate
+	ServiceName       string        // Service of the webhook, the serving certificate DNS names
+	WebhookConfigName string        // MutatingWebhookConfiguration whose caBundle is reconciled
+	LeaseName         string        // Lease electing the replica rotating the certificates
+	Identity          string        // Identity of the replica in the Lease, e.g. the pod name
+	CAValidity        time.Duration // Validity of the generated CA
+	CertValidity      time.Duration // Validity of the generated serving certificates
+	RenewBefore       time.Duration // Certificates are renewed that long before they expire
+}
+
+// CertificateManager keeps the webhook certificates of a SelfManagedCertConfig. Every
+// replica serves the keypair of the Secret, the leader generates the CA and the serving
+// certificate, renews them before expiry and keeps the caBundle up to date.
+type CertificateManager struct {
+	client       kubernetes.Interface
+	config       SelfManagedCertConfig
+	certificates *CertificateReloader
+	logger       *slog.Logger
+	now          func() time.Time
+}
+
+// NewCertificateManager creates a manager serving the Secret keypair through certificates.
+// Zero durations default, RenewBefore must be shorter than both validities, else the
+// certificates would be renewed on every reconciliation.
+func NewCertificateManager(
+	client kubernetes.Interface,
+	config SelfManagedCertConfig,
+	certificates *CertificateReloader,
+	logger *slog.Logger,
+) (*CertificateManager, error) {
+	if config.CAValidity == 0 {
+		config.CAValidity = DefaultCAValidity
+	}
+	if config.CertValidity == 0 {
+		config.CertValidity = DefaultCertValidity
+	}
+	if config.RenewBefore == 0 {
+		config.RenewBefore = DefaultRenewBefore
+	}
+	if config.RenewBefore < 0 || config.RenewBefore >= config.CertValidity || config.RenewBefore >= config.CAValidity {
+		return nil, fmt.Errorf(
+			"renewBefore %s must be positive and shorter than the certificate validity %s and the CA validity %s",
+			config.RenewBefore,
+			config.CertValidity,
+			config.CAValidity,
+		)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &CertificateManager{
+		client:       client,
+		config:       config,
+		certificates: certificates,
+		logger:       logger.With("secret", config.Namespace+"/"+config.SecretName),
+		now:          time.Now,
+	}, nil
+}
+
+// Start watches the Secret and runs the leader election until stopCh is closed.
+func (m *CertificateManager) Start(stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		m.client,
+		0,
+		informers.WithNamespace(m.config.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", m.config.SecretName).String()
+		}),
+	)
+	_, err := factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { m.serve(obj) },
+		UpdateFunc: func(_, obj interface{}) { m.serve(obj) },
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(stopCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	go m.runLeaderElection(ctx)
+
+	return nil
+}
+
+// serve swaps in the serving keypair of the Secret.
+func (m *CertificateManager) serve(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || secret.Name != m.config.SecretName {
+		return
+	}
+	_, err := m.certificates.Update(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		m.logger.Warn("Keeping the previous serving certificate", "error", err)
+	}
+}
+
+// runLeaderElection campaigns for the Lease until ctx is done, the leader reconciles the
+// certificates until it loses the Lease.
+func (m *CertificateManager) runLeaderElection(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: m.config.Namespace, Name: m.config.LeaseName},
+		Client:     m.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: m.config.Identity},
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            m.config.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: m.reconcileLoop,
+				OnStoppedLeading: func() {
+					m.logger.Info("Stopped leading the certificate rotation", "identity", m.config.Identity)
+				},
+			},
+		})
+	}
+}
+
+// reconcileLoop reconciles the certificates until ctx is done, retrying failures.
+func (m *CertificateManager) reconcileLoop(ctx context.Context) {
+	m.logger.Info("Leading the certificate rotation", "identity", m.config.Identity)
+	for {
+		next, err := m.reconcile(ctx)
+		if err != nil {
+			m.logger.Error("Error reconciling the webhook certificates", "error", err)
+			next = retryPeriod
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// reconcile renews the CA and the serving certificate of the Secret when they are missing,
+// invalid or about to expire, and sets the caBundle of the webhook configuration. It
+// returns the time until the next reconciliation.
+//
+// A new CA is published in the Secret and the caBundle next to the previous one, while the
+// replicas keep serving the certificate of the previous CA. The serving certificate is only
+// signed by the new CA on a later reconciliation, once the caBundle already holds it.
+func (m *CertificateManager) reconcile(ctx context.Context) (time.Duration, error) {
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+	secret, err := secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+	create := k8serrors.IsNotFound(err)
+	if create {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.config.Namespace, Name: m.config.SecretName},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("could not get Secret: %w", err)
+	}
+
+	now := m.now()
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	if err := m.renewCA(data, now); err != nil {
+		return 0, err
+	}
+	cas, _ := parseCertificates(data[secretCACert])
+	caKey, _ := parsePrivateKey(data[secretCAKey])
+	// Without a usable serving certificate there is nothing to keep serving until the new
+	// CA propagates, and the Secret must hold one anyway.
+	if _, err := parseKeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey], "certificate"); err != nil {
+		if err := m.renewServingCert(data, cas[0], caKey, now); err != nil {
+			return 0, err
+		}
+	}
+	if secret, err = m.storeSecret(ctx, secret, data, create); err != nil {
+		return 0, err
+	}
+
+	updated, err := m.reconcileCABundle(ctx, data[secretCACert])
+	if err != nil {
+		return 0, err
+	}
+	serving, _ := parseCertificates(data[corev1.TLSCertKey])
+	if updated && serving[0].CheckSignatureFrom(cas[0]) != nil {
+		m.logger.Info("Waiting for the new CA to propagate before signing the serving certificate")
+		return caPropagationDelay, nil
+	}
+
+	if !m.servingValid(data, cas[0], now) {
+		if err := m.renewServingCert(data, cas[0], caKey, now); err != nil {
+			return 0, err
+		}
+		if _, err = m.storeSecret(ctx, secret, data, false); err != nil {
+			return 0, err
+		}
+	}
+
+	serving, _ = parseCertificates(data[corev1.TLSCertKey])
+	next := min(
+		cas[0].NotAfter.Sub(now)-m.config.RenewBefore,
+		serving[0].NotAfter.Sub(now)-m.config.RenewBefore,
+		certificateResync,
+	)
+
+	return max(next, retryPeriod), nil
+}
+
+// storeSecret creates or updates the Secret when its data differs, and returns it.
+func (m *CertificateManager) storeSecret(
+	ctx context.Context,
+	secret *corev1.Secret,
+	data map[string][]byte,
+	create bool,
+) (*corev1.Secret, error) {
+	if reflect.DeepEqual(secret.Data, data) {
+		return secret, nil
+	}
+
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+	updated := secret.DeepCopy()
+	updated.Data = map[string][]byte{}
+	for key, value := range data {
+		updated.Data[key] = value
+	}
+	var err error
+	if create {
+		updated, err = secrets.Create(ctx, updated, metav1.CreateOptions{})
+	} else {
+		updated, err = secrets.Update(ctx, updated, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not store the certificates in the Secret: %w", err)
+	}
+
+	return updated, nil
+}
+
+// renewCA generates a new CA in data when it is missing, invalid or about to expire, and
+// drops the expired CAs of the bundle.
+func (m *CertificateManager) renewCA(data map[string][]byte, now time.Time) error {
+	caCerts, _ := parseCertificates(data[secretCACert])
+	caKey, err := parsePrivateKey(data[secretCAKey])
+	caValid := err == nil && len(caCerts) > 0 && m.fresh(caCerts[0], now) && matchesKey(caCerts[0], caKey)
+
+	ca, previous := (*x509.Certificate)(nil), caCerts
+	if caValid {
+		ca, previous = caCerts[0], caCerts[1:]
+	} else {
+		m.logger.Info("Generating the webhook CA")
+		ca, caKey, err = m.generateCA(now)
+		if err != nil {
+			return err
+		}
+		if data[secretCAKey], err = encodePrivateKey(caKey); err != nil {
+			return err
+		}
+	}
+
+	// The previous CAs stay in the caBundle until they expire, so that the replicas still
+	// serving a certificate they signed are trusted until they pick the new one.
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	for _, cert := range previous {
+		if now.Before(cert.NotAfter) {
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+	data[secretCACert] = bundle
+
+	return nil
+}
+
+// renewServingCert stores in data a new serving certificate signed by ca.
+func (m *CertificateManager) renewServingCert(
+	data map[string][]byte,
+	ca *x509.Certificate,
+	caKey crypto.Signer,
+	now time.Time,
+) error {
+	m.logger.Info("Generating the webhook serving certificate")
+	certPEM, keyPEM, err := m.generateServingCert(ca, caKey, now)
+	if err != nil {
+		return err
+	}
+	data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey] = certPEM, keyPEM
+
+	return nil
+}
+
+// servingValid reports whether the serving keypair of data is signed by ca, covers the
+// Service and does not need renewal.
+func (m *CertificateManager) servingValid(data map[string][]byte, ca *x509.Certificate, now time.Time) bool {
+	keyPair, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil || !m.fresh(cert, now) || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	return cert.VerifyHostname(m.serviceDNSNames()[0]) == nil
+}
+
+// fresh reports whether cert is valid at now and for longer than RenewBefore.
+func (m *CertificateManager) fresh(cert *x509.Certificate, now time.Time) bool {
+	return !now.Before(cert.NotBefore) && now.Add(m.config.RenewBefore).Before(cert.NotAfter)
+}
+
+// reconcileCABundle sets caBundle as the CA of every webhook of the configuration. It
+// reports whether the configuration was updated.
+func (m *CertificateManager) reconcileCABundle(ctx context.Context, caBundle []byte) (bool, error) {
+	webhooks := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := webhooks.Get(ctx, m.config.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not get MutatingWebhookConfiguration %s: %w", m.config.WebhookConfigName, err)
+	}
+
+	updated := config.DeepCopy()
+	changed := false
+	for i := range updated.Webhooks {
+		if !bytes.Equal(updated.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			updated.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	if _, err := webhooks.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("could not update the caBundle of %s: %w", m.config.WebhookConfigName, err)
+	}
+	m.logger.Info("Updated the caBundle", "webhookConfiguration", m.config.WebhookConfigName)
+
+	return true, nil
+}
+
+// serviceDNSNames returns the names the apiserver may use to reach the Service.
+func (m *CertificateManager) serviceDNSNames() []string {
+	service := m.config.ServiceName + "." + m.config.Namespace + ".svc"
+
+	return []string{
+		service,
+		service + ".cluster.local",
+		m.config.ServiceName + "." + m.config.Namespace,
+		m.config.ServiceName,
+	}
+}
+
+// generateCA returns a new self-signed CA certificate and its key.
+func (m *CertificateManager) generateCA(now time.Time) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: m.config.ServiceName + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(m.config.CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create the CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
+
+// generateServingCert returns a new serving certificate signed by ca and its key, in PEM.
+func (m *CertificateManager) generateServingCert(
+	ca *x509.Certificate,
+	caKey crypto.Signer,
+	now time.Time,
+) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	dnsNames := m.serviceDNSNames()
+	notAfter := now.Add(m.config.CertValidity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create the serving certificate: %w", err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// randomSerial returns a random 128 bits certificate serial number.
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// parseCertificates parses the certificates of the PEM bundle.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// parsePrivateKey parses a PKCS8 PEM private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+
+	return signer, nil
+}
+
+// encodePrivateKey encodes key as a PKCS8 PEM private key.
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// matchesKey reports whether key is the private key of cert.
+func matchesKey(cert *x509.Certificate, key crypto.Signer) bool {
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+
+	return ok && public.Equal(cert.PublicKey)
+}
@@ -0,0 +1,240 @@
+package inject
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testCertConfig() SelfManagedCertConfig {
+	return SelfManagedCertConfig{
+		Namespace:         "injector",
+		SecretName:        "k8-injector-certs",
+		ServiceName:       "k8-injector",
+		WebhookConfigName: "k8-injector",
+		LeaseName:         "k8-injector-certs",
+		Identity:          "k8-injector-0",
+	}
+}
+
+func testWebhookConfiguration() *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8-injector"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "kubernetes-injector.server-lab.info"}},
+	}
+}
+
+// certSecret returns the certificate Secret and the certificates it holds.
+func certSecret(t *testing.T, client *fake.Clientset) (*corev1.Secret, []*x509.Certificate, *x509.Certificate) {
+	secret, err := client.CoreV1().Secrets("injector").Get(context.Background(), "k8-injector-certs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := parseCertificates(secret.Data[secretCACert])
+	if err != nil || len(cas) == 0 {
+		t.Fatalf("invalid CA bundle: %v", err)
+	}
+	serving, err := parseCertificates(secret.Data[corev1.TLSCertKey])
+	if err != nil || len(serving) == 0 {
+		t.Fatalf("invalid serving certificate: %v", err)
+	}
+
+	return secret, cas, serving[0]
+}
+
+func caBundle(t *testing.T, client *fake.Clientset) []byte {
+	webhooks := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := webhooks.Get(context.Background(), "k8-injector", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config.Webhooks[0].ClientConfig.CABundle
+}
+
+func TestNewCertificateManagerRenewBefore(t *testing.T) {
+	tests := []struct {
+		name         string
+		caValidity   time.Duration
+		certValidity time.Duration
+		renewBefore  time.Duration
+		valid        bool
+	}{
+		{name: "defaults", valid: true},
+		{name: "renewBefore shorter", certValidity: 48 * time.Hour, renewBefore: 24 * time.Hour, valid: true},
+		{name: "certValidity shorter than the default renewBefore", certValidity: 24 * time.Hour},
+		{name: "renewBefore equal to certValidity", certValidity: 24 * time.Hour, renewBefore: 24 * time.Hour},
+		{name: "caValidity shorter than renewBefore", caValidity: 12 * time.Hour, renewBefore: 24 * time.Hour},
+		{name: "negative renewBefore", renewBefore: -time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testCertConfig()
+			config.CAValidity = test.caValidity
+			config.CertValidity = test.certValidity
+			config.RenewBefore = test.renewBefore
+			_, err := NewCertificateManager(fake.NewSimpleClientset(), config, nil, nil)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "renewBefore")
+			}
+		})
+	}
+}
+
+func TestCertificateManagerReconcile(t *testing.T) {
+	client := fake.NewSimpleClientset(testWebhookConfiguration())
+	manager, err := NewCertificateManager(client, testCertConfig(), nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	manager.now = func() time.Time { return now }
+
+	next, err := manager.reconcile(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, certificateResync, next)
+
+	secret, cas, serving := certSecret(t, client)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	assert.Len(t, cas, 1)
+	assert.Equal(t, secret.Data[secretCACert], caBundle(t, client))
+	roots := x509.NewCertPool()
+	roots.AddCert(cas[0])
+	_, err = serving.Verify(x509.VerifyOptions{Roots: roots, DNSName: "k8-injector.injector.svc"})
+	assert.NoError(t, err)
+
+	// Valid certificates are left untouched, a reset caBundle is restored.
+	config := testWebhookConfiguration()
+	_, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(
+		context.Background(),
+		config,
+		metav1.UpdateOptions{},
+	)
+	assert.NoError(t, err)
+	client.ClearActions()
+	_, err = manager.reconcile(context.Background())
+	assert.NoError(t, err)
+	for _, action := range client.Actions() {
+		assert.False(t, action.Matches("update", "secrets"), "the Secret is not updated")
+	}
+	unchanged, _, _ := certSecret(t, client)
+	assert.Equal(t, secret.Data, unchanged.Data)
+	assert.Equal(t, secret.Data[secretCACert], caBundle(t, client))
+
+	// The serving certificate is renewed before it expires, with the same CA.
+	now = serving.NotAfter.Add(-DefaultRenewBefore + time.Hour)
+	_, err = manager.reconcile(context.Background())
+	assert.NoError(t, err)
+	_, renewedCAs, renewed := certSecret(t, client)
+	assert.NotEqual(t, serving.SerialNumber, renewed.SerialNumber)
+	assert.Equal(t, cas[0].Raw, renewedCAs[0].Raw)
+	assert.True(t, renewed.NotAfter.After(serving.NotAfter))
+}
+
+func TestCertificateManagerCARotation(t *testing.T) {
+	client := fake.NewSimpleClientset(testWebhookConfiguration())
+	config := testCertConfig()
+	config.CAValidity = 90 * 24 * time.Hour
+	config.CertValidity = 30 * 24 * time.Hour
+	config.RenewBefore = 10 * 24 * time.Hour
+	manager, err := NewCertificateManager(client, config, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	manager.now = func() time.Time { return now }
+
+	next, err := manager.reconcile(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, certificateResync, next)
+	_, cas, initial := certSecret(t, client)
+
+	// The serving certificate is not signed by the new CA while the caBundle update fails.
+	now = cas[0].NotAfter.Add(-config.RenewBefore + time.Hour)
+	failUpdates := true
+	failUpdate := func(k8stesting.Action) (bool, runtime.Object, error) {
+		return failUpdates, nil, errors.New("connection refused")
+	}
+	client.PrependReactor("update", "mutatingwebhookconfigurations", failUpdate)
+	for i := 0; i < 2; i++ {
+		_, err = manager.reconcile(context.Background())
+		assert.ErrorContains(t, err, "connection refused")
+		_, _, serving := certSecret(t, client)
+		assert.Equal(t, initial.Raw, serving.Raw)
+	}
+	failUpdates = false
+
+	// The new CA is published next to the previous one, the serving certificate is kept.
+	next, err = manager.reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, caPropagationDelay, next)
+	secret, rotated, serving := certSecret(t, client)
+	if !assert.Len(t, rotated, 2, "the previous CA stays in the bundle until it expires") {
+		return
+	}
+	assert.Equal(t, cas[0].Raw, rotated[1].Raw)
+	assert.Equal(t, initial.Raw, serving.Raw)
+	assert.Equal(t, secret.Data[secretCACert], caBundle(t, client))
+
+	// The serving certificate is signed by the new CA once the caBundle holds it.
+	next, err = manager.reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, certificateResync, next)
+	_, resigned, serving := certSecret(t, client)
+	assert.Equal(t, rotated[0].Raw, resigned[0].Raw)
+	assert.NoError(t, serving.CheckSignatureFrom(rotated[0]))
+
+	now = cas[0].NotAfter.Add(time.Hour)
+	_, err = manager.reconcile(context.Background())
+	assert.NoError(t, err)
+	_, pruned, _ := certSecret(t, client)
+	assert.Len(t, pruned, 1, "the expired CA is dropped from the bundle")
+}
+
+func TestCertificateManagerStart(t *testing.T) {
+	client := fake.NewSimpleClientset(testWebhookConfiguration())
+	certificates, err := NewCertificateReloader("", "", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, certificates.Leaf())
+
+	manager, err := NewCertificateManager(client, testCertConfig(), certificates, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if !assert.NoError(t, manager.Start(stopCh)) {
+		return
+	}
+
+	assert.Eventually(t, func() bool {
+		return certificates.Leaf() != nil
+	}, 10*time.Second, 10*time.Millisecond)
+	_, _, serving := certSecret(t, client)
+	assert.Equal(t, serving.SerialNumber, certificates.Leaf().SerialNumber)
+	assert.NotEmpty(t, caBundle(t, client))
+
+	leases := client.CoordinationV1().Leases("injector")
+	lease, err := leases.Get(context.Background(), "k8-injector-certs", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k8-injector-0", *lease.Spec.HolderIdentity)
+	}
+}